@@ -0,0 +1,263 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyVaultRefContentType marks App Configuration key-values which refer to
+// Key Vault secrets.
+const keyVaultRefContentType = "application/vnd.microsoft.appconfig.keyvaultref+json"
+
+// AppConfigurationBackend reads key-values from Azure App Configuration and
+// resolves Key Vault references through AzureKeyVaultBackend.
+type AppConfigurationBackend struct {
+	credential  azureCredential
+	scope       string
+	endpoint    string
+	label       string
+	httpClient  *http.Client
+	token       string
+	tokenExpiry time.Time
+	keys        map[string][]string
+	vaults      map[string]*AzureKeyVaultBackend
+	mu          sync.Mutex
+}
+
+type keyValue struct {
+	Key          string    `json:"key"`
+	Label        string    `json:"label"`
+	ContentType  string    `json:"content_type"`
+	Value        string    `json:"value"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+type keyValueListResponse struct {
+	Items    []keyValue `json:"items"`
+	NextLink string     `json:"@nextLink"`
+}
+
+type keyVaultReference struct {
+	URI string `json:"uri"`
+}
+
+// NewAppConfigurationBackend reads key-values with the given label. Empty
+// label selects key-values without label. Credentials are configured same
+// way as with Azure Key Vault.
+func NewAppConfigurationBackend(endpoint, label string) (*AppConfigurationBackend, error) {
+	cloud, err := azureCloudFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cloud.appConfigSuffix == "" {
+		return nil, fmt.Errorf("AZURE_APPCONFIG_SCOPE_SUFFIX is required for custom cloud")
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	cred, err := newAzureCredential(httpClient, cloud)
+	if err != nil {
+		return nil, err
+	}
+	if label == "" {
+		// Null label is matched with \0
+		label = "\x00"
+	}
+	return &AppConfigurationBackend{
+		credential: cred,
+		scope:      "https://" + cloud.appConfigSuffix + "/.default",
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		label:      label,
+		httpClient: httpClient,
+		keys:       make(map[string][]string),
+		vaults:     make(map[string]*AzureKeyVaultBackend),
+	}, nil
+}
+
+func (b *AppConfigurationBackend) acquireToken() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Until(b.tokenExpiry) > time.Minute {
+		return b.token, nil
+	}
+	tr, err := b.credential.token(b.scope)
+	if err != nil {
+		return "", err
+	}
+	expiresIn, err := tr.ExpiresIn.Int64()
+	if err != nil {
+		return "", fmt.Errorf("error decoding token expiry: %v", err)
+	}
+	b.token = tr.AccessToken
+	b.tokenExpiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return b.token, nil
+}
+
+func (b *AppConfigurationBackend) get(path string, out interface{}) error {
+	token, err := b.acquireToken()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", b.endpoint+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
+
+// https://learn.microsoft.com/en-us/azure/azure-app-configuration/rest-api-key-value#get-key-value
+func (b *AppConfigurationBackend) FetchSecret(secretName string) (*FetchSecretResponse, error) {
+	key, err := b.key(secretName)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("label", b.label)
+	query.Set("api-version", "1.0")
+	var kv keyValue
+	if err := b.get("/kv/"+url.PathEscape(key)+"?"+query.Encode(), &kv); err != nil {
+		return nil, fmt.Errorf("error fetching key %s: %v", key, err)
+	}
+
+	mediaType, _, _ := strings.Cut(kv.ContentType, ";")
+	if strings.TrimSpace(mediaType) != keyVaultRefContentType {
+		return &FetchSecretResponse{
+			Value:     kv.Value,
+			UpdatedAt: kv.LastModified,
+		}, nil
+	}
+
+	var ref keyVaultReference
+	if err := json.Unmarshal([]byte(kv.Value), &ref); err != nil {
+		return nil, fmt.Errorf("error decoding Key Vault reference of key %s: %v", key, err)
+	}
+	vault, name, err := b.vault(ref.URI)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving Key Vault reference of key %s: %v", key, err)
+	}
+	return vault.FetchSecret(name)
+}
+
+// https://learn.microsoft.com/en-us/azure/azure-app-configuration/rest-api-key-value#list-key-values
+func (b *AppConfigurationBackend) ListSecrets() ([]string, error) {
+	query := url.Values{}
+	query.Set("label", b.label)
+	query.Set("api-version", "1.0")
+	next := "/kv?" + query.Encode()
+
+	keys := make(map[string][]string)
+	for next != "" {
+		var lr keyValueListResponse
+		if err := b.get(next, &lr); err != nil {
+			return nil, fmt.Errorf("error listing key-values: %v", err)
+		}
+		for _, kv := range lr.Items {
+			name := volumeName(kv.Key)
+			keys[name] = append(keys[name], kv.Key)
+		}
+		next = lr.NextLink
+	}
+
+	// Keys which differ only by case or punctuation are not listed because
+	// volume name cannot tell which one of them to use
+	var names []string
+	for name, k := range keys {
+		if len(k) == 1 {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	b.mu.Lock()
+	b.keys = keys
+	b.mu.Unlock()
+	return names, nil
+}
+
+// key returns App Configuration key of volume name. Keys are listed again
+// when name is not known, e.g. after restart. Other names are used as keys
+// as is.
+func (b *AppConfigurationBackend) key(secretName string) (string, error) {
+	keys, ok := b.lookup(secretName)
+	if !ok {
+		if _, err := b.ListSecrets(); err != nil {
+			return "", err
+		}
+		keys, ok = b.lookup(secretName)
+	}
+	switch {
+	case !ok:
+		return secretName, nil
+	case len(keys) > 1:
+		return "", fmt.Errorf("volume %s matches to multiple keys (%s), rename them to differ by more than case or punctuation", secretName, strings.Join(keys, ", "))
+	}
+	return keys[0], nil
+}
+
+// lookup returns keys which volume name matches to. Name which is a key
+// itself matches only to that key.
+func (b *AppConfigurationBackend) lookup(secretName string) ([]string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if slices.Contains(b.keys[volumeName(secretName)], secretName) {
+		return []string{secretName}, true
+	}
+	keys, ok := b.keys[secretName]
+	return keys, ok
+}
+
+// vault returns Key Vault backend and secret name of Key Vault secret URI.
+func (b *AppConfigurationBackend) vault(uri string) (*AzureKeyVaultBackend, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	name, ok := strings.CutPrefix(strings.Trim(u.Path, "/"), "secrets/")
+	if !ok || name == "" {
+		return nil, "", fmt.Errorf("%s is not Key Vault secret URI", uri)
+	}
+	vaultURL := u.Scheme + "://" + u.Host
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vault, ok := b.vaults[vaultURL]
+	if !ok {
+		if vault, err = NewAzureKeyVaultBackend(vaultURL); err != nil {
+			return nil, "", err
+		}
+		b.vaults[vaultURL] = vault
+	}
+	return vault, name, nil
+}
+
+// volumeName converts App Configuration key, e.g. App:Db:Password, to valid
+// volume name app-db-password.
+func volumeName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, key)
+}
@@ -1,45 +1,124 @@
 package backend
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
 	"sync"
 	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
 )
 
+// defaultIMDSEndpoint is token endpoint of Azure Instance Metadata Service.
+const defaultIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// versionHistory is number of secret versions kept for rollback.
+const versionHistory = 5
+
+// versionsMaxAge is how long listed versions are shown in volume status
+// before they are listed again.
+const versionsMaxAge = time.Minute
+
+// PreviousVersion selects the version before current one of a secret.
+const PreviousVersion = "previous"
+
+var versionID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// defaultKeyVaultAPIVersion is used unless AZURE_KEYVAULT_API_VERSION is set.
+const defaultKeyVaultAPIVersion = "7.4"
+
+// azureCloud holds endpoints which differ between Azure clouds.
+type azureCloud struct {
+	authorityHost   string
+	keyVaultSuffix  string
+	appConfigSuffix string
+}
+
+var azureClouds = map[string]azureCloud{
+	"AzurePublic": {
+		authorityHost:   "https://login.microsoftonline.com",
+		keyVaultSuffix:  "vault.azure.net",
+		appConfigSuffix: "azconfig.io",
+	},
+	"AzureUSGovernment": {
+		authorityHost:   "https://login.microsoftonline.us",
+		keyVaultSuffix:  "vault.usgovcloudapi.net",
+		appConfigSuffix: "azconfig.azure.us",
+	},
+	"AzureChina": {
+		authorityHost:   "https://login.chinacloudapi.cn",
+		keyVaultSuffix:  "vault.azure.cn",
+		appConfigSuffix: "azconfig.azure.cn",
+	},
+}
+
 type AzureKeyVaultBackend struct {
-	tenantID     string
-	clientID     string
-	clientSecret string
-	vaultURL     string
-	httpClient   *http.Client
-	token        string
-	tokenExpiry  time.Time
-	mu           sync.Mutex
+	credential  azureCredential
+	scope       string
+	apiVersion  string
+	pfxPassword string
+	tagFilter   map[string]string
+	vaultURL    string
+	httpClient  *http.Client
+	token       string
+	tokenExpiry time.Time
+	versions    map[string]listedVersions
+	mu          sync.Mutex
 }
 
+type secretVersion struct {
+	ID      string
+	Created time.Time
+}
+
+type listedVersions struct {
+	versions []secretVersion
+	listedAt time.Time
+}
+
+// IMDS returns expires_in as string so it is decoded as json.Number
 type tokenResponse struct {
-	AccessToken string `json:"access_token"`
-	ExpiresIn   int    `json:"expires_in"`
+	AccessToken string      `json:"access_token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+type secretAttributes struct {
+	Enabled bool  `json:"enabled"`
+	Nbf     int64 `json:"nbf"`
+	Exp     int64 `json:"exp"`
+	Created int64 `json:"created"`
+	Updated int64 `json:"updated"`
 }
 
 type secretResponse struct {
-	Value      string `json:"value"`
-	Attributes struct {
-		Exp     int64 `json:"exp"`
-		Updated int64 `json:"updated"`
-	} `json:"attributes"`
+	Value       string            `json:"value"`
+	ContentType string            `json:"contentType"`
+	Attributes  secretAttributes  `json:"attributes"`
+	Tags        map[string]string `json:"tags"`
 }
 
 type listResponse struct {
 	Value []struct {
-		ID string `json:"id"`
+		ID         string            `json:"id"`
+		Attributes secretAttributes  `json:"attributes"`
+		Tags       map[string]string `json:"tags"`
 	} `json:"value"`
 	NextLink string `json:"nextLink"`
 }
@@ -53,55 +132,104 @@ func (sr *secretResponse) UpdatedAt() time.Time {
 }
 
 func NewAzureKeyVaultBackend(vaultURL string) (*AzureKeyVaultBackend, error) {
-	tid := os.Getenv("AZURE_TENANT_ID")
-	cid := os.Getenv("AZURE_CLIENT_ID")
-	csecret := os.Getenv("AZURE_CLIENT_SECRET")
-	if tid == "" || cid == "" || csecret == "" {
-		return nil, fmt.Errorf("AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET are required")
+	cloud, err := azureCloudFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	cred, err := newAzureCredential(httpClient, cloud)
+	if err != nil {
+		return nil, err
+	}
+	apiVersion := os.Getenv("AZURE_KEYVAULT_API_VERSION")
+	if apiVersion == "" {
+		apiVersion = defaultKeyVaultAPIVersion
+	}
+	tagFilter := make(map[string]string)
+	if f := os.Getenv("AZURE_KEYVAULT_TAG_FILTER"); f != "" {
+		for _, tag := range strings.Split(f, ",") {
+			k, v, ok := strings.Cut(strings.TrimSpace(tag), "=")
+			if !ok || k == "" {
+				return nil, fmt.Errorf("invalid AZURE_KEYVAULT_TAG_FILTER entry %q, expected name=value", tag)
+			}
+			tagFilter[k] = v
+		}
 	}
 	return &AzureKeyVaultBackend{
-		tenantID:     tid,
-		clientID:     cid,
-		clientSecret: csecret,
-		vaultURL:     strings.TrimRight(vaultURL, "/"),
-		httpClient:   &http.Client{Timeout: 5 * time.Second},
+		credential:  cred,
+		scope:       "https://" + cloud.keyVaultSuffix + "/.default",
+		apiVersion:  apiVersion,
+		pfxPassword: os.Getenv("AZURE_CERTIFICATE_PFX_PASSWORD"),
+		tagFilter:   tagFilter,
+		vaultURL:    strings.TrimRight(vaultURL, "/"),
+		httpClient:  httpClient,
+		versions:    make(map[string]listedVersions),
 	}, nil
 }
 
+// azureCloudFromEnv returns cloud selected with AZURE_CLOUD. AZURE_AUTHORITY_HOST
+// and AZURE_KEYVAULT_SCOPE_SUFFIX override its endpoints and are required
+// for clouds without built-in profile.
+func azureCloudFromEnv() (azureCloud, error) {
+	name := os.Getenv("AZURE_CLOUD")
+	if name == "" {
+		name = "AzurePublic"
+	}
+	cloud := azureClouds[name]
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		cloud.authorityHost = host
+	}
+	if suffix := os.Getenv("AZURE_KEYVAULT_SCOPE_SUFFIX"); suffix != "" {
+		cloud.keyVaultSuffix = suffix
+	}
+	if suffix := os.Getenv("AZURE_APPCONFIG_SCOPE_SUFFIX"); suffix != "" {
+		cloud.appConfigSuffix = suffix
+	}
+	if cloud.authorityHost == "" || cloud.keyVaultSuffix == "" {
+		return cloud, fmt.Errorf("unknown AZURE_CLOUD %q, AZURE_AUTHORITY_HOST and AZURE_KEYVAULT_SCOPE_SUFFIX are required for custom cloud", name)
+	}
+	cloud.authorityHost = strings.TrimRight(cloud.authorityHost, "/")
+	return cloud, nil
+}
+
 func (b *AzureKeyVaultBackend) acquireToken() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	if time.Until(b.tokenExpiry) > time.Minute {
 		return nil
 	}
-	endpoint := fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", b.tenantID)
-	data := url.Values{}
-	data.Set("grant_type", "client_credentials")
-	data.Set("client_id", b.clientID)
-	data.Set("client_secret", b.clientSecret)
-	data.Set("scope", b.vaultURL+"/.default")
-	resp, err := b.httpClient.PostForm(endpoint, data)
+	tr, err := b.credential.token(b.scope)
 	if err != nil {
-		return fmt.Errorf("failed to request token: %v", err)
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
-	}
-	var tr tokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-		return fmt.Errorf("error decoding token response: %v", err)
+	expiresIn, err := tr.ExpiresIn.Int64()
+	if err != nil {
+		return fmt.Errorf("error decoding token expiry: %v", err)
 	}
 	b.token = tr.AccessToken
-	b.tokenExpiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	b.tokenExpiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
 	return nil
 }
 
+// FetchSecret returns current version of secret or the version given as
+// <secret>/<version> where version can also be "previous".
 // https://learn.microsoft.com/en-us/rest/api/keyvault/secrets/get-secret/get-secret
 func (b *AzureKeyVaultBackend) FetchSecret(secretName string) (*FetchSecretResponse, error) {
 	if err := b.acquireToken(); err != nil {
 		return nil, err
 	}
-	url := fmt.Sprintf("%s/secrets/%s?api-version=7.4", b.vaultURL, url.PathEscape(secretName))
+	name, version, _ := strings.Cut(secretName, "/")
+	if version == PreviousVersion {
+		versions, err := b.secretVersions(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) < 2 {
+			return nil, fmt.Errorf("secret %s does not have previous version", name)
+		}
+		version = versions[1].ID
+	}
+	url := fmt.Sprintf("%s/secrets/%s/%s?api-version=%s", b.vaultURL, url.PathEscape(name), url.PathEscape(version), b.apiVersion)
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Set("Authorization", "Bearer "+b.token)
 	resp, err := b.httpClient.Do(req)
@@ -110,12 +238,30 @@ func (b *AzureKeyVaultBackend) FetchSecret(secretName string) (*FetchSecretRespo
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		if strings.Contains(string(body), "SecretDisabled") {
+			return nil, &UnavailableError{Reason: fmt.Sprintf("secret %s is disabled", secretName)}
+		}
 		return nil, fmt.Errorf("failed to fetch secret %s: status %d", secretName, resp.StatusCode)
 	}
 	var sr secretResponse
 	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
 		return nil, fmt.Errorf("error decoding secret %s: %v", secretName, err)
 	}
+	if reason := b.unavailable(sr.Attributes, sr.Tags); reason != "" {
+		return nil, &UnavailableError{Reason: fmt.Sprintf("secret %s %s", secretName, reason)}
+	}
+	if isCertificate(sr.ContentType) {
+		files, cert, err := certificateFiles(sr.ContentType, sr.Value, b.pfxPassword)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate %s: %v", secretName, err)
+		}
+		return &FetchSecretResponse{
+			Files:     files,
+			UpdatedAt: sr.UpdatedAt(),
+			ExpiresAt: cert.NotAfter,
+		}, nil
+	}
 	return &FetchSecretResponse{
 		Value:     sr.Value,
 		UpdatedAt: sr.UpdatedAt(),
@@ -123,13 +269,116 @@ func (b *AzureKeyVaultBackend) FetchSecret(secretName string) (*FetchSecretRespo
 	}, nil
 }
 
+// ResolveSecret maps volume names <secret>.previous and <secret>.<version> to
+// pinned versions of secret so host can be rolled back to earlier secret.
+func (b *AzureKeyVaultBackend) ResolveSecret(volumeName string) (string, bool) {
+	i := strings.LastIndex(volumeName, ".")
+	if i <= 0 {
+		return "", false
+	}
+	version := volumeName[i+1:]
+	if version != PreviousVersion && !versionID.MatchString(version) {
+		return "", false
+	}
+	return volumeName[:i] + "/" + version, true
+}
+
+// secretVersions returns latest enabled versions of secret, newest first.
+// https://learn.microsoft.com/en-us/rest/api/keyvault/secrets/get-secret-versions/get-secret-versions
+func (b *AzureKeyVaultBackend) secretVersions(name string) ([]secretVersion, error) {
+	var versions []secretVersion
+	next := fmt.Sprintf("%s/secrets/%s/versions?api-version=%s", b.vaultURL, url.PathEscape(name), b.apiVersion)
+	for next != "" {
+		req, _ := http.NewRequest("GET", next, nil)
+		req.Header.Set("Authorization", "Bearer "+b.token)
+		resp, err := b.httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error listing versions of secret %s: %v", name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list versions of secret %s: status %d", name, resp.StatusCode)
+		}
+		var lr listResponse
+		if err := json.Unmarshal(body, &lr); err != nil {
+			return nil, fmt.Errorf("error unmarshalling versions response: %v", err)
+		}
+		for _, item := range lr.Value {
+			if !item.Attributes.Enabled {
+				continue
+			}
+			versions = append(versions, secretVersion{
+				ID:      item.ID[strings.LastIndex(item.ID, "/")+1:],
+				Created: time.Unix(item.Attributes.Created, 0),
+			})
+		}
+		next = lr.NextLink
+	}
+	slices.SortFunc(versions, func(a, b secretVersion) int {
+		return b.Created.Compare(a.Created)
+	})
+	if len(versions) > versionHistory {
+		versions = versions[:versionHistory]
+	}
+
+	b.mu.Lock()
+	b.versions[name] = listedVersions{versions: versions, listedAt: time.Now()}
+	b.mu.Unlock()
+	return versions, nil
+}
+
+// VersionHistory returns latest versions of secret known so far. Docker calls
+// Get often and must not wait for Key Vault, so versions are listed in
+// background at most once in versionsMaxAge, also when listing fails.
+func (b *AzureKeyVaultBackend) VersionHistory(secretName string) []string {
+	name, _, _ := strings.Cut(secretName, "/")
+	if name == "" {
+		return nil
+	}
+	b.mu.Lock()
+	listed, ok := b.versions[name]
+	if !ok || time.Since(listed.listedAt) > versionsMaxAge {
+		b.versions[name] = listedVersions{versions: listed.versions, listedAt: time.Now()}
+		go func() {
+			// Version history is only informative so errors are ignored
+			if err := b.acquireToken(); err == nil {
+				b.secretVersions(name)
+			}
+		}()
+	}
+	b.mu.Unlock()
+	var ids []string
+	for _, v := range listed.versions {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+// unavailable tells why secret must not be used or returns empty string if
+// it can be used.
+func (b *AzureKeyVaultBackend) unavailable(attrs secretAttributes, tags map[string]string) string {
+	if !attrs.Enabled {
+		return "is disabled"
+	}
+	if attrs.Nbf > 0 && time.Now().Before(time.Unix(attrs.Nbf, 0)) {
+		return fmt.Sprintf("is not valid before %s", time.Unix(attrs.Nbf, 0).Format(time.RFC3339))
+	}
+	for k, v := range b.tagFilter {
+		if tags[k] != v {
+			return fmt.Sprintf("does not have tag %s=%s", k, v)
+		}
+	}
+	return ""
+}
+
 // https://learn.microsoft.com/en-us/rest/api/keyvault/secrets/get-secrets/get-secrets
 func (b *AzureKeyVaultBackend) ListSecrets() ([]string, error) {
 	if err := b.acquireToken(); err != nil {
 		return nil, err
 	}
 	var names []string
-	next := fmt.Sprintf("%s/secrets?api-version=7.4", b.vaultURL)
+	next := fmt.Sprintf("%s/secrets?api-version=%s", b.vaultURL, b.apiVersion)
 	for next != "" {
 		req, _ := http.NewRequest("GET", next, nil)
 		req.Header.Set("Authorization", "Bearer "+b.token)
@@ -144,6 +393,9 @@ func (b *AzureKeyVaultBackend) ListSecrets() ([]string, error) {
 			return nil, fmt.Errorf("error unmarshalling list response: %v", err)
 		}
 		for _, item := range lr.Value {
+			if b.unavailable(item.Attributes, item.Tags) != "" {
+				continue
+			}
 			parts := strings.Split(item.ID, "/")
 			slices.Reverse(parts)
 			names = append(names, parts[0])
@@ -152,3 +404,265 @@ func (b *AzureKeyVaultBackend) ListSecrets() ([]string, error) {
 	}
 	return names, nil
 }
+
+// azureCredential acquires Microsoft Entra ID access tokens.
+type azureCredential interface {
+	token(scope string) (*tokenResponse, error)
+}
+
+// newAzureCredential picks credential type based on environment variables
+// in order client secret, client certificate, federated token file and
+// managed identity of Azure VM.
+func newAzureCredential(httpClient *http.Client, cloud azureCloud) (azureCredential, error) {
+	tid := os.Getenv("AZURE_TENANT_ID")
+	cid := os.Getenv("AZURE_CLIENT_ID")
+	csecret := os.Getenv("AZURE_CLIENT_SECRET")
+	certPath := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH")
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+
+	if csecret == "" && certPath == "" && tokenFile == "" {
+		imds := os.Getenv("AZURE_IMDS_ENDPOINT")
+		if imds == "" {
+			imds = defaultIMDSEndpoint
+		}
+		return &managedIdentityCredential{
+			client:   httpClient,
+			endpoint: imds,
+			clientID: cid,
+		}, nil
+	}
+	if tid == "" || cid == "" {
+		return nil, fmt.Errorf("AZURE_TENANT_ID and AZURE_CLIENT_ID are required")
+	}
+	app := entraApp{
+		client:        httpClient,
+		authorityHost: cloud.authorityHost,
+		tenantID:      tid,
+		clientID:      cid,
+	}
+
+	switch {
+	case csecret != "":
+		return &clientSecretCredential{
+			entraApp: app,
+			secret:   csecret,
+		}, nil
+	case certPath != "":
+		key, cert, err := loadClientCertificate(certPath, os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		return &clientCertificateCredential{
+			entraApp: app,
+			key:      key,
+			cert:     cert,
+		}, nil
+	default:
+		return &federatedCredential{
+			entraApp:  app,
+			tokenFile: tokenFile,
+		}, nil
+	}
+}
+
+// entraApp holds application registration which service principal
+// credentials authenticate as.
+type entraApp struct {
+	client        *http.Client
+	authorityHost string
+	tenantID      string
+	clientID      string
+}
+
+type clientSecretCredential struct {
+	entraApp
+	secret string
+}
+
+func (c *clientSecretCredential) token(scope string) (*tokenResponse, error) {
+	data := url.Values{}
+	data.Set("client_secret", c.secret)
+	return c.requestToken(scope, data)
+}
+
+// federatedCredential uses token issued by another identity provider, e.g.
+// Kubernetes service account token of workload identity, as client assertion.
+// https://learn.microsoft.com/en-us/entra/identity-platform/v2-oauth2-client-creds-grant-flow#third-case-access-token-request-with-a-federated-credential
+type federatedCredential struct {
+	entraApp
+	tokenFile string
+}
+
+func (c *federatedCredential) token(scope string) (*tokenResponse, error) {
+	// Token file is rotated by its issuer so it is read on every request
+	assertion, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading federated token: %v", err)
+	}
+	data := url.Values{}
+	data.Set("client_assertion_type", clientAssertionType)
+	data.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	return c.requestToken(scope, data)
+}
+
+// clientCertificateCredential signs client assertion with certificate
+// registered to application.
+// https://learn.microsoft.com/en-us/entra/identity-platform/certificate-credentials
+type clientCertificateCredential struct {
+	entraApp
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func (c *clientCertificateCredential) token(scope string) (*tokenResponse, error) {
+	assertion, err := c.assertion()
+	if err != nil {
+		return nil, fmt.Errorf("error signing client assertion: %v", err)
+	}
+	data := url.Values{}
+	data.Set("client_assertion_type", clientAssertionType)
+	data.Set("client_assertion", assertion)
+	return c.requestToken(scope, data)
+}
+
+func (c *clientCertificateCredential) assertion() (string, error) {
+	thumbprint := sha1.Sum(c.cert.Raw)
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"aud": c.tokenEndpoint(),
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	}
+
+	var parts []string
+	for _, v := range []interface{}{header, claims} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(data))
+	}
+	digest := sha256.Sum256([]byte(strings.Join(parts, ".")))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(parts, base64.RawURLEncoding.EncodeToString(sig)), "."), nil
+}
+
+// loadClientCertificate reads RSA private key and certificate from PEM or
+// PKCS#12 file.
+func loadClientCertificate(path, password string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading client certificate: %v", err)
+	}
+
+	var key interface{}
+	var cert *x509.Certificate
+	if strings.EqualFold(filepath.Ext(path), ".pem") {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			switch block.Type {
+			case "CERTIFICATE":
+				if cert == nil {
+					cert, err = x509.ParseCertificate(block.Bytes)
+				}
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("error parsing client certificate: %v", err)
+			}
+		}
+	} else {
+		key, cert, _, err = pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding client certificate: %v", err)
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("client certificate %s must contain both certificate and private key", path)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("client certificate %s private key must be RSA key", path)
+	}
+	return rsaKey, cert, nil
+}
+
+// https://learn.microsoft.com/en-us/entra/identity/managed-identities-azure-resources/how-to-use-vm-token
+type managedIdentityCredential struct {
+	client   *http.Client
+	endpoint string
+	clientID string
+}
+
+func (c *managedIdentityCredential) token(scope string) (*tokenResponse, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", strings.TrimSuffix(scope, "/.default"))
+	if c.clientID != "" {
+		query.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequest("GET", c.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request managed identity token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("managed identity endpoint returned %d: %s", resp.StatusCode, string(body))
+	}
+	return decodeToken(resp.Body)
+}
+
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+func (a *entraApp) tokenEndpoint() string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", a.authorityHost, a.tenantID)
+}
+
+// requestToken posts client credentials grant with the given client
+// authentication parameters to Microsoft Entra ID.
+func (a *entraApp) requestToken(scope string, data url.Values) (*tokenResponse, error) {
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_id", a.clientID)
+	data.Set("scope", scope)
+	resp, err := a.client.PostForm(a.tokenEndpoint(), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
+	}
+	return decodeToken(resp.Body)
+}
+
+func decodeToken(body io.Reader) (*tokenResponse, error) {
+	var tr tokenResponse
+	if err := json.NewDecoder(body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("error decoding token response: %v", err)
+	}
+	return &tr, nil
+}
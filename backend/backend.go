@@ -1,11 +1,102 @@
 package backend
 
 import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 )
 
+// JSONField is the field name which renders all fields of a secret as one
+// JSON object.
+const JSONField = "json"
+
 type FetchSecretResponse struct {
-	Value     string
+	// Value holds the secret of single value backends.
+	Value string
+	// Fields holds all values of multi-field secrets and DefaultField the
+	// name of the one used when no field is selected.
+	Fields       map[string]string
+	DefaultField string
+	// Files makes volume a directory containing these files.
+	Files     map[string]string
 	UpdatedAt time.Time
 	ExpiresAt time.Time
+	// RefreshAt tells when secret must be fetched again while it is mounted,
+	// e.g. to renew a lease. Zero means never.
+	RefreshAt time.Time
+}
+
+// Field returns the value of a single field. An empty name selects the
+// default value and fails if the secret has multiple fields but none of them
+// is the default one.
+func (r *FetchSecretResponse) Field(name string) (string, error) {
+	if len(r.Fields) == 0 {
+		if name != "" {
+			return "", fmt.Errorf("secret does not have field %q", name)
+		}
+		return r.Value, nil
+	}
+
+	switch name {
+	case "":
+		if v, ok := r.Fields[r.DefaultField]; ok {
+			return v, nil
+		}
+		if len(r.Fields) == 1 {
+			for _, v := range r.Fields {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("secret has multiple fields (%s), select one of them", strings.Join(r.fieldNames(), ", "))
+	case JSONField:
+		if _, ok := r.Fields[JSONField]; ok {
+			return "", fmt.Errorf("field %q is ambiguous, secret has a field with the same name", JSONField)
+		}
+		data, err := json.Marshal(r.Fields)
+		if err != nil {
+			return "", fmt.Errorf("error encoding fields: %v", err)
+		}
+		return string(data), nil
+	}
+
+	if v, ok := r.Fields[name]; ok {
+		return v, nil
+	}
+	// Volume names are lower case so fall back to case-insensitive match
+	var matches []string
+	for k := range r.Fields {
+		if strings.EqualFold(k, name) {
+			matches = append(matches, k)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("secret does not have field %q, available fields: %s", name, strings.Join(r.fieldNames(), ", "))
+	case 1:
+		return r.Fields[matches[0]], nil
+	default:
+		slices.Sort(matches)
+		return "", fmt.Errorf("field %q is ambiguous, matches %s", name, strings.Join(matches, ", "))
+	}
+}
+
+// UnavailableError tells that secret exists but must not be mounted, e.g.
+// because it is disabled.
+type UnavailableError struct {
+	Reason string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Reason
+}
+
+func (r *FetchSecretResponse) fieldNames() []string {
+	names := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	return names
 }
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFetchSecretResponseField(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  FetchSecretResponse
+		field   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "single value",
+			secret: FetchSecretResponse{Value: "pw"},
+			want:   "pw",
+		},
+		{
+			name:    "field of single value",
+			secret:  FetchSecretResponse{Value: "pw"},
+			field:   "user",
+			wantErr: `does not have field "user"`,
+		},
+		{
+			name:   "default field",
+			secret: FetchSecretResponse{Fields: map[string]string{"Secret": "pw", "user": "app"}, DefaultField: "Secret"},
+			want:   "pw",
+		},
+		{
+			name:   "only field",
+			secret: FetchSecretResponse{Fields: map[string]string{"user": "app"}, DefaultField: "Secret"},
+			want:   "app",
+		},
+		{
+			name:    "multiple fields without default",
+			secret:  FetchSecretResponse{Fields: map[string]string{"user": "app", "password": "pw"}},
+			wantErr: "select one of them",
+		},
+		{
+			name:   "exact field",
+			secret: FetchSecretResponse{Fields: map[string]string{"user": "app", "User": "other"}},
+			field:  "User",
+			want:   "other",
+		},
+		{
+			name:   "case-insensitive fallback",
+			secret: FetchSecretResponse{Fields: map[string]string{"UserName": "app"}},
+			field:  "username",
+			want:   "app",
+		},
+		{
+			name:    "ambiguous case-insensitive match",
+			secret:  FetchSecretResponse{Fields: map[string]string{"UserName": "a", "USERNAME": "b"}},
+			field:   "username",
+			wantErr: "is ambiguous, matches USERNAME, UserName",
+		},
+		{
+			name:    "missing field",
+			secret:  FetchSecretResponse{Fields: map[string]string{"user": "app"}},
+			field:   "password",
+			wantErr: "available fields: user",
+		},
+		{
+			name:   "all fields as JSON",
+			secret: FetchSecretResponse{Fields: map[string]string{"user": "app", "password": "pw"}},
+			field:  JSONField,
+			want:   `{"password":"pw","user":"app"}`,
+		},
+		{
+			name:    "JSON clashing with field",
+			secret:  FetchSecretResponse{Fields: map[string]string{"json": "{}", "user": "app"}},
+			field:   JSONField,
+			wantErr: "is ambiguous",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.secret.Field(tt.field)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Content types of Key Vault secrets which back certificates.
+const (
+	contentTypePKCS12 = "application/x-pkcs12"
+	contentTypePEM    = "application/x-pem-file"
+)
+
+// certificateFiles splits certificate with private key to cert.pem, key.pem
+// and chain.pem. With pfxPassword cert.pfx protected by it is added too.
+func certificateFiles(contentType, value, pfxPassword string) (map[string]string, *x509.Certificate, error) {
+	var key interface{}
+	var leaf *x509.Certificate
+	var chain []*x509.Certificate
+
+	switch contentType {
+	case contentTypePKCS12:
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error decoding PKCS#12 data: %v", err)
+		}
+		if key, leaf, chain, err = pkcs12.DecodeChain(data, ""); err != nil {
+			return nil, nil, fmt.Errorf("error decoding PKCS#12 data: %v", err)
+		}
+	case contentTypePEM:
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			switch block.Type {
+			case "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error parsing certificate: %v", err)
+				}
+				if leaf == nil {
+					leaf = cert
+				} else {
+					chain = append(chain, cert)
+				}
+			case "PRIVATE KEY":
+				k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("error parsing private key: %v", err)
+				}
+				key = k
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported certificate content type %q", contentType)
+	}
+	if leaf == nil || key == nil {
+		return nil, nil, fmt.Errorf("certificate must contain both certificate and private key")
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error encoding private key: %v", err)
+	}
+	files := map[string]string{
+		"cert.pem":  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})),
+		"key.pem":   string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		"chain.pem": "",
+	}
+	for _, c := range chain {
+		files["chain.pem"] += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}))
+	}
+	if pfxPassword != "" {
+		pfx, err := pkcs12.Modern.Encode(key, leaf, chain, pfxPassword)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error encoding PKCS#12 file: %v", err)
+		}
+		files["cert.pfx"] = string(pfx)
+	}
+	return files, leaf, nil
+}
+
+// isCertificate tells if Key Vault secret backs a certificate.
+func isCertificate(contentType string) bool {
+	return contentType == contentTypePKCS12 || contentType == contentTypePEM
+}
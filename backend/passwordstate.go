@@ -5,99 +5,366 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// PasswordIDPrefix is prefix of volumes which select password by its ID,
+// e.g. id-1234.
+const PasswordIDPrefix = "id-"
+
+var passwordID = regexp.MustCompile(`^` + PasswordIDPrefix + `([0-9]+)$`)
+
 type passwordResponse struct {
-	PasswordID int    `json:"PasswordID"`
-	Title      string `json:"Title"`
-	Password   string `json:"Password"`
-	ExpiryDate string `json:"ExpiryDate"`
+	PasswordID     int    `json:"PasswordID"`
+	PasswordListID int    `json:"PasswordListID"`
+	Title          string `json:"Title"`
+	Domain         string `json:"Domain"`
+	HostName       string `json:"HostName"`
+	UserName       string `json:"UserName"`
+	Description    string `json:"Description"`
+	GenericField1  string `json:"GenericField1"`
+	GenericField2  string `json:"GenericField2"`
+	GenericField3  string `json:"GenericField3"`
+	GenericField4  string `json:"GenericField4"`
+	GenericField5  string `json:"GenericField5"`
+	GenericField6  string `json:"GenericField6"`
+	GenericField7  string `json:"GenericField7"`
+	GenericField8  string `json:"GenericField8"`
+	GenericField9  string `json:"GenericField9"`
+	GenericField10 string `json:"GenericField10"`
+	AccountType    string `json:"AccountType"`
+	Notes          string `json:"Notes"`
+	URL            string `json:"URL"`
+	Password       string `json:"Password"`
+	ExpiryDate     string `json:"ExpiryDate"`
+}
+
+// fields returns non-empty fields of password entry. Password is always
+// included because it is the default field.
+func (p *passwordResponse) fields() map[string]string {
+	fields := map[string]string{
+		"Password": p.Password,
+	}
+	for name, value := range map[string]string{
+		"Title":          p.Title,
+		"Domain":         p.Domain,
+		"HostName":       p.HostName,
+		"UserName":       p.UserName,
+		"Description":    p.Description,
+		"GenericField1":  p.GenericField1,
+		"GenericField2":  p.GenericField2,
+		"GenericField3":  p.GenericField3,
+		"GenericField4":  p.GenericField4,
+		"GenericField5":  p.GenericField5,
+		"GenericField6":  p.GenericField6,
+		"GenericField7":  p.GenericField7,
+		"GenericField8":  p.GenericField8,
+		"GenericField9":  p.GenericField9,
+		"GenericField10": p.GenericField10,
+		"AccountType":    p.AccountType,
+		"Notes":          p.Notes,
+		"URL":            p.URL,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+type passwordListResponse struct {
+	PasswordListID int    `json:"PasswordListID"`
+	PasswordList   string `json:"PasswordList"`
+	TreePath       string `json:"TreePath"`
 }
 
 type PasswordstateBackend struct {
-	baseURL string
-	apiKey  string
-	listID  string
+	client   *http.Client
+	baseURL  string
+	apiKey   string
+	audit    bool
+	listIDs  []string
+	treePath string
+	lists    []string
+	mu       sync.Mutex
 }
 
-func NewPasswordstateBackend(baseURL, apiKey, listID string) *PasswordstateBackend {
+// NewPasswordstateBackend serves passwords of given lists and lists under
+// treePath. Volume names are prefixed with list ID, e.g. 123.sql-admin,
+// unless only one list is given. Accesses are hidden from Passwordstate
+// auditing unless audit is set.
+func NewPasswordstateBackend(baseURL, apiKey string, listIDs []string, treePath string, audit bool) *PasswordstateBackend {
 	return &PasswordstateBackend{
-		baseURL: baseURL,
-		apiKey:  apiKey,
-		listID:  listID,
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		baseURL:  baseURL,
+		apiKey:   apiKey,
+		audit:    audit,
+		listIDs:  listIDs,
+		treePath: strings.TrimRight(treePath, `\`),
 	}
 }
 
-func (b *PasswordstateBackend) FetchSecret(secretName string) (*FetchSecretResponse, error) {
-	url := fmt.Sprintf("%s/searchpasswords/%s?title=%s&PreventAuditing=true", b.baseURL, b.listID, url.QueryEscape(secretName))
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+// namespaced tells if volume names contain list ID.
+func (b *PasswordstateBackend) namespaced() bool {
+	return len(b.listIDs) != 1 || b.treePath != ""
+}
+
+// get sends request to Passwordstate API. When auditing is enabled, reason
+// is shown in the audit trail of accessed passwords.
+func (b *PasswordstateBackend) get(path string, query url.Values, reason string, out interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	if !b.audit {
+		query.Set("PreventAuditing", "true")
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", b.baseURL+path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating HTTP request: %v", err)
+		return fmt.Errorf("error creating HTTP request: %v", err)
 	}
 	req.Header.Set("APIKey", b.apiKey)
-	resp, err := client.Do(req)
+	if b.audit && reason != "" {
+		req.Header.Set("Reason", reason)
+	}
+	resp, err := b.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error searching for password: %v", err)
+		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response from Passwordstate: status code %d", resp.StatusCode)
+		return fmt.Errorf("unexpected response from Passwordstate: status code %d", resp.StatusCode)
 	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
 
-	var passwords []passwordResponse
-	if err := json.NewDecoder(resp.Body).Decode(&passwords); err != nil {
-		return nil, fmt.Errorf("error decoding password response: %v", err)
+// ResolveSecret allows mounting password by its ID with volume name
+// id-<PasswordID>.
+func (b *PasswordstateBackend) ResolveSecret(volumeName string) (string, bool) {
+	m := passwordID.FindStringSubmatch(volumeName)
+	if m == nil {
+		return "", false
 	}
+	return "id/" + m[1], true
+}
 
-	if len(passwords) == 0 {
-		return nil, fmt.Errorf("no password found with title %q in list %q", secretName, b.listID)
+func (b *PasswordstateBackend) FetchSecret(secretName string) (*FetchSecretResponse, error) {
+	return b.FetchSecretAudited(secretName, "")
+}
+
+// FetchSecretAudited fetches secret and tells the reason of access to
+// Passwordstate audit trail.
+func (b *PasswordstateBackend) FetchSecretAudited(secretName, reason string) (*FetchSecretResponse, error) {
+	var password passwordResponse
+	var err error
+	if id, ok := strings.CutPrefix(secretName, "id/"); ok {
+		password, err = b.fetchByID(id, reason)
+	} else {
+		password, err = b.fetchByTitle(secretName, reason)
 	}
-	password := passwords[0]
+	if err != nil {
+		return nil, err
+	}
+	return password.response(secretName), nil
+}
 
-	expiry, err := time.Parse("2.1.2006", password.ExpiryDate)
+// FetchSecrets fetches many secrets with one request per list. When auditing
+// is enabled secrets are fetched one by one because fetching whole list
+// would record access to all of its passwords.
+func (b *PasswordstateBackend) FetchSecrets(secretNames []string, reason string) (map[string]*FetchSecretResponse, error) {
+	secrets := make(map[string]*FetchSecretResponse, len(secretNames))
+	titles := make(map[string]map[string]string)
+	for _, secretName := range secretNames {
+		if b.audit || strings.HasPrefix(secretName, "id/") {
+			secret, err := b.FetchSecretAudited(secretName, reason)
+			if err != nil {
+				return nil, err
+			}
+			secrets[secretName] = secret
+			continue
+		}
+		listID, title, err := b.splitName(secretName)
+		if err != nil {
+			return nil, err
+		}
+		if titles[listID] == nil {
+			titles[listID] = make(map[string]string)
+		}
+		titles[listID][title] = secretName
+	}
+
+	for listID, names := range titles {
+		var passwords []passwordResponse
+		if err := b.get("/searchpasswords/"+listID, nil, reason, &passwords); err != nil {
+			return nil, fmt.Errorf("error listing passwords of list %s: %v", listID, err)
+		}
+		for title, secretName := range names {
+			password, err := matchTitle(passwords, listID, title)
+			if err != nil {
+				return nil, err
+			}
+			secrets[secretName] = password.response(secretName)
+		}
+	}
+	return secrets, nil
+}
+
+func (p *passwordResponse) response(secretName string) *FetchSecretResponse {
+	expiry, err := time.Parse("2.1.2006", p.ExpiryDate)
 	if err != nil {
-		fmt.Printf("error parsing expiry date %v for secret %v : %v", password.ExpiryDate, secretName, err)
+		fmt.Printf("error parsing expiry date %v for secret %v : %v", p.ExpiryDate, secretName, err)
 	}
 	return &FetchSecretResponse{
-		Value:     password.Password,
-		UpdatedAt: time.Now(),
-		ExpiresAt: expiry,
-	}, nil
+		Fields:       p.fields(),
+		DefaultField: "Password",
+		UpdatedAt:    time.Now(),
+		ExpiresAt:    expiry,
+	}
 }
 
-func (b *PasswordstateBackend) ListSecrets() ([]string, error) {
-	url := fmt.Sprintf("%s/searchpasswords/%s?PreventAuditing=true", b.baseURL, b.listID)
-	client := &http.Client{
-		Timeout: 5 * time.Second,
+// splitName returns list ID and title of secret.
+func (b *PasswordstateBackend) splitName(secretName string) (string, string, error) {
+	if !b.namespaced() {
+		return b.listIDs[0], secretName, nil
 	}
-	req, err := http.NewRequest("GET", url, nil)
+	listID, title, ok := strings.Cut(secretName, ".")
+	if !ok {
+		return "", "", fmt.Errorf("secret name %q does not contain list ID", secretName)
+	}
+	lists, err := b.passwordLists(false)
 	if err != nil {
-		return nil, fmt.Errorf("error creating HTTP request for listing: %v", err)
+		return "", "", err
 	}
-	req.Header.Set("APIKey", b.apiKey)
-	resp, err := client.Do(req)
+	if !slices.Contains(lists, listID) {
+		return "", "", fmt.Errorf("list %q is not configured", listID)
+	}
+	return listID, title, nil
+}
+
+func (b *PasswordstateBackend) fetchByTitle(secretName, reason string) (passwordResponse, error) {
+	listID, title, err := b.splitName(secretName)
 	if err != nil {
-		return nil, fmt.Errorf("error listing passwords: %v", err)
+		return passwordResponse{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response from Passwordstate when listing: status code %d", resp.StatusCode)
+	var passwords []passwordResponse
+	query := url.Values{}
+	query.Set("title", title)
+	if err := b.get("/searchpasswords/"+listID, query, reason, &passwords); err != nil {
+		return passwordResponse{}, fmt.Errorf("error searching for password: %v", err)
 	}
+	return matchTitle(passwords, listID, title)
+}
 
+// matchTitle returns the only password with exact title. Search matches
+// also to partial titles.
+func matchTitle(passwords []passwordResponse, listID, title string) (passwordResponse, error) {
+	var matches []passwordResponse
+	for _, p := range passwords {
+		if p.Title == title {
+			matches = append(matches, p)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return passwordResponse{}, fmt.Errorf("no password found with title %q in list %q", title, listID)
+	case 1:
+		return matches[0], nil
+	}
+	ids := make([]string, 0, len(matches))
+	for _, p := range matches {
+		ids = append(ids, PasswordIDPrefix+strconv.Itoa(p.PasswordID))
+	}
+	return passwordResponse{}, fmt.Errorf("title %q is ambiguous in list %q, use one of volumes %s instead", title, listID, strings.Join(ids, ", "))
+}
+
+func (b *PasswordstateBackend) fetchByID(id, reason string) (passwordResponse, error) {
 	var passwords []passwordResponse
-	if err := json.NewDecoder(resp.Body).Decode(&passwords); err != nil {
-		return nil, fmt.Errorf("error decoding password list response: %v", err)
+	if err := b.get("/passwords/"+id, nil, reason, &passwords); err != nil {
+		return passwordResponse{}, fmt.Errorf("error reading password %s: %v", id, err)
+	}
+	if len(passwords) == 0 {
+		return passwordResponse{}, fmt.Errorf("no password found with ID %s", id)
+	}
+	password := passwords[0]
+
+	// API key might have access to other lists too
+	lists, err := b.passwordLists(false)
+	if err != nil {
+		return passwordResponse{}, err
+	}
+	if !slices.Contains(lists, strconv.Itoa(password.PasswordListID)) {
+		return passwordResponse{}, fmt.Errorf("password %s is not in configured lists", id)
 	}
+	return password, nil
+}
+
+// passwordLists returns IDs of configured lists. Lists under tree path are
+// looked up again when refresh is set or they are not known yet.
+func (b *PasswordstateBackend) passwordLists(refresh bool) ([]string, error) {
+	if b.treePath == "" {
+		return b.listIDs, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lists != nil && !refresh {
+		return b.lists, nil
+	}
+	var pls []passwordListResponse
+	if err := b.get("/passwordlists", nil, "", &pls); err != nil {
+		return nil, fmt.Errorf("error listing password lists: %v", err)
+	}
+	lists := slices.Clone(b.listIDs)
+	for _, pl := range pls {
+		if strings.EqualFold(pl.TreePath, b.treePath) || strings.HasPrefix(strings.ToLower(pl.TreePath), strings.ToLower(b.treePath)+`\`) {
+			id := strconv.Itoa(pl.PasswordListID)
+			if !slices.Contains(lists, id) {
+				lists = append(lists, id)
+			}
+		}
+	}
+	b.lists = lists
+	return lists, nil
+}
+
+func (b *PasswordstateBackend) ListSecrets() ([]string, error) {
+	lists, err := b.passwordLists(true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listing returns whole entries so it is audited too
+	host, _ := os.Hostname()
+	reason := fmt.Sprintf("docker-secretprovider-plugin on %s listing secrets", host)
 
 	var titles []string
-	for _, p := range passwords {
-		titles = append(titles, p.Title)
+	for _, listID := range lists {
+		var passwords []passwordResponse
+		if err := b.get("/searchpasswords/"+listID, nil, reason, &passwords); err != nil {
+			return nil, fmt.Errorf("error listing passwords of list %s: %v", listID, err)
+		}
+		for _, p := range passwords {
+			if b.namespaced() {
+				titles = append(titles, listID+"."+p.Title)
+			} else {
+				titles = append(titles, p.Title)
+			}
+		}
 	}
 	return titles, nil
 }
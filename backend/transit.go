@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// transitPrefix starts every ciphertext produced by Vault Transit engine.
+const transitPrefix = "vault:v"
+
+// TransitDecrypter decrypts Vault Transit ciphertexts stored to any backend
+// so only hosts with access to the Transit key can read the secrets.
+type TransitDecrypter struct {
+	vault *VaultBackend
+	path  string
+	key   string
+}
+
+type decryptResponse struct {
+	Data struct {
+		Plaintext string `json:"plaintext"`
+	} `json:"data"`
+}
+
+func NewTransitDecrypter(vault *VaultBackend, path, key string) *TransitDecrypter {
+	return &TransitDecrypter{
+		vault: vault,
+		path:  strings.Trim(path, "/"),
+		key:   key,
+	}
+}
+
+// DecryptSecret returns copy of secret which values are decrypted.
+func (t *TransitDecrypter) DecryptSecret(secretName string, secret *FetchSecretResponse) (*FetchSecretResponse, error) {
+	plain := *secret
+	var err error
+	if plain.Value, err = t.decrypt(secret.Value); err != nil {
+		return nil, fmt.Errorf("error decrypting secret %s: %v", secretName, err)
+	}
+	// Backends might keep the maps so they are not modified
+	for _, m := range []*map[string]string{&plain.Fields, &plain.Files} {
+		if *m == nil {
+			continue
+		}
+		decrypted := make(map[string]string, len(*m))
+		for k, v := range *m {
+			if decrypted[k], err = t.decrypt(v); err != nil {
+				return nil, fmt.Errorf("error decrypting %s of secret %s: %v", k, secretName, err)
+			}
+		}
+		*m = decrypted
+	}
+	return &plain, nil
+}
+
+// decrypt returns plaintext of Transit ciphertext and other values as is.
+// https://developer.hashicorp.com/vault/api-docs/secret/transit#decrypt-data
+func (t *TransitDecrypter) decrypt(value string) (string, error) {
+	ciphertext := strings.TrimSpace(value)
+	if !strings.HasPrefix(ciphertext, transitPrefix) {
+		return value, nil
+	}
+	var dr decryptResponse
+	body := map[string]string{"ciphertext": ciphertext}
+	if err := t.vault.do("PUT", fmt.Sprintf("%s/decrypt/%s", t.path, t.key), body, &dr); err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(dr.Data.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("error decoding plaintext: %v", err)
+	}
+	return string(plaintext), nil
+}
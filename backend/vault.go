@@ -1,17 +1,42 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+var errVaultNotFound = errors.New("not found")
+
 type VaultBackend struct {
-	client    *http.Client
-	vaultAddr string
-	path      string
-	token     string
+	client       *http.Client
+	vaultAddr    string
+	path         string
+	token        string
+	databasePath string
+	leases       map[string]*vaultLease
+
+	pkiPath          string
+	pkiCommonName    string
+	pkiTTL           string
+	pkiRenewFraction float64
+	certs            map[string]*vaultCertificate
+
+	roleID     string
+	secretID   string
+	renewToken bool
+	// tokenExpiry tells when AppRole token expires or when renewed token
+	// must be renewed next time
+	tokenExpiry time.Time
+	authMu      sync.Mutex
+
+	mu sync.Mutex
 }
 
 type secretDataResponse struct {
@@ -36,17 +61,76 @@ func NewVaultBackend(vaultAddr, path, token string) (*VaultBackend, error) {
 		vaultAddr: vaultAddr,
 		path:      path,
 		token:     token,
+		leases:    make(map[string]*vaultLease),
+		certs:     make(map[string]*vaultCertificate),
 	}, nil
 }
 
+// do sends authenticated request to Vault API path and decodes JSON response
+// to out.
+func (b *VaultBackend) do(method, path string, body, out interface{}) error {
+	token, err := b.authToken()
+	if err != nil {
+		return err
+	}
+	return b.send(method, path, token, body, out)
+}
+
+func (b *VaultBackend) send(method, path, token string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", b.vaultAddr, path), r)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errVaultNotFound
+	case resp.StatusCode >= 300:
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	case out == nil || resp.StatusCode == http.StatusNoContent:
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
+
 // https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#read-secret-version
 func (b *VaultBackend) FetchSecret(secretName string) (*FetchSecretResponse, error) {
+	if role, ok := b.databaseRole(secretName); ok {
+		return b.fetchDatabaseCredentials(role)
+	}
+	if role, ok := b.pkiRole(secretName); ok {
+		return b.fetchCertificate(role)
+	}
+
+	token, err := b.authToken()
+	if err != nil {
+		return nil, err
+	}
 	url := fmt.Sprintf("%s/v1/%s/data/%s", b.vaultAddr, b.path, secretName)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
-	req.Header.Set("X-Vault-Token", b.token)
+	req.Header.Set("X-Vault-Token", token)
 	resp, err := b.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error reading secret %s: %v", secretName, err)
@@ -61,15 +145,6 @@ func (b *VaultBackend) FetchSecret(secretName string) (*FetchSecretResponse, err
 		return nil, fmt.Errorf("error decoding secret response: %v", err)
 	}
 
-	// extract the 'Secret' field, fallback to first entry if missing
-	value, ok := sdr.Data.Data["Secret"]
-	if !ok {
-		for _, v := range sdr.Data.Data {
-			value = v
-			break
-		}
-	}
-
 	// parse creation timestamp
 	createdAt, err := time.Parse(time.RFC3339, sdr.Data.Metadata.CreatedTime)
 	if err != nil {
@@ -85,32 +160,90 @@ func (b *VaultBackend) FetchSecret(secretName string) (*FetchSecretResponse, err
 		}
 	}
 
+	// 'Secret' is used when no field is selected because of compatibility
+	// with other backends
 	return &FetchSecretResponse{
-		Value:     value,
-		UpdatedAt: createdAt,
-		ExpiresAt: expiresAt,
+		Fields:       sdr.Data.Data,
+		DefaultField: "Secret",
+		UpdatedAt:    createdAt,
+		ExpiresAt:    expiresAt,
 	}, nil
 }
 
-// https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#list-secrets
 func (b *VaultBackend) ListSecrets() ([]string, error) {
+	var names []string
+	if b.path != "" {
+		keys, err := b.listKVSecrets("")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, keys...)
+	}
+	if b.databasePath != "" {
+		roles, err := b.listDatabaseRoles()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, roles...)
+	}
+	if b.pkiPath != "" {
+		roles, err := b.listPKIRoles()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, roles...)
+	}
+	return names, nil
+}
+
+// listKVSecrets lists secrets in folder. Keys ending with / are folders which
+// are listed recursively so nested secrets are named like app/db.
+// https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#list-secrets
+func (b *VaultBackend) listKVSecrets(folder string) ([]string, error) {
+	token, err := b.authToken()
+	if err != nil {
+		return nil, err
+	}
 	url := fmt.Sprintf("%s/v1/%s/metadata?list=true", b.vaultAddr, b.path)
+	if folder != "" {
+		url = fmt.Sprintf("%s/v1/%s/metadata/%s?list=true", b.vaultAddr, b.path, strings.TrimSuffix(folder, "/"))
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create list request: %v", err)
 	}
-	req.Header.Set("X-Vault-Token", b.token)
+	req.Header.Set("X-Vault-Token", token)
 	resp, err := b.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error listing secrets: %v", err)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("listing secrets failed: status %d", resp.StatusCode)
-	}
 	var lkr listKeysResponse
-	if err := json.NewDecoder(resp.Body).Decode(&lkr); err != nil {
-		return nil, fmt.Errorf("error decoding list keys response: %v", err)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && folder != "":
+		// Folder was emptied after its parent was listed
+	case resp.StatusCode != http.StatusOK:
+		err = fmt.Errorf("listing secrets failed: status %d", resp.StatusCode)
+	default:
+		if derr := json.NewDecoder(resp.Body).Decode(&lkr); derr != nil {
+			err = fmt.Errorf("error decoding list keys response: %v", derr)
+		}
+	}
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range lkr.Data.Keys {
+		if !strings.HasSuffix(key, "/") {
+			names = append(names, folder+key)
+			continue
+		}
+		nested, err := b.listKVSecrets(folder + key)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, nested...)
 	}
-	return lkr.Data.Keys, nil
+	return names, nil
 }
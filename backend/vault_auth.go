@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+)
+
+// VaultCredential is the credential delivered inside a response-wrapped token.
+type VaultCredential struct {
+	Token    string `json:",omitempty"`
+	SecretID string `json:",omitempty"`
+}
+
+type authResponse struct {
+	Auth *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Data struct {
+		SecretID string `json:"secret_id"`
+	} `json:"data"`
+}
+
+// NewVaultAppRoleBackend logs in to Vault with AppRole on first request and
+// logs in again whenever the token is about to expire.
+func NewVaultAppRoleBackend(vaultAddr, path, roleID, secretID string) (*VaultBackend, error) {
+	b, err := NewVaultBackend(vaultAddr, path, "")
+	if err != nil {
+		return nil, err
+	}
+	b.roleID = roleID
+	b.secretID = secretID
+	return b, nil
+}
+
+// NewVaultRenewedTokenBackend uses token which is renewed in background so it
+// does not expire while the plugin is running.
+func NewVaultRenewedTokenBackend(vaultAddr, path, token string) (*VaultBackend, error) {
+	b, err := NewVaultBackend(vaultAddr, path, token)
+	if err != nil {
+		return nil, err
+	}
+	b.renewToken = true
+	go func() {
+		for range time.Tick(time.Minute) {
+			b.authToken()
+		}
+	}()
+	return b, nil
+}
+
+// UnwrapVaultCredential exchanges single use wrapping token to the credential
+// it wraps. Either token or AppRole secret ID is supported.
+// https://developer.hashicorp.com/vault/api-docs/system/wrapping-unwrap
+func UnwrapVaultCredential(vaultAddr, wrappingToken string) (*VaultCredential, error) {
+	b, err := NewVaultBackend(vaultAddr, "", wrappingToken)
+	if err != nil {
+		return nil, err
+	}
+	var ar authResponse
+	if err := b.send("POST", "sys/wrapping/unwrap", wrappingToken, nil, &ar); err != nil {
+		return nil, fmt.Errorf("error unwrapping token: %v", err)
+	}
+	switch {
+	case ar.Auth != nil && ar.Auth.ClientToken != "":
+		return &VaultCredential{Token: ar.Auth.ClientToken}, nil
+	case ar.Data.SecretID != "":
+		return &VaultCredential{SecretID: ar.Data.SecretID}, nil
+	}
+	return nil, fmt.Errorf("wrapped response contains neither token nor secret_id")
+}
+
+// authToken returns token for Vault requests and logs in with AppRole when
+// token is missing or about to expire.
+// https://developer.hashicorp.com/vault/api-docs/auth/approle#login-with-approle
+func (b *VaultBackend) authToken() (string, error) {
+	b.authMu.Lock()
+	defer b.authMu.Unlock()
+	if b.renewToken {
+		return b.renewedToken(), nil
+	}
+	if b.roleID == "" || time.Until(b.tokenExpiry) > time.Minute {
+		return b.token, nil
+	}
+
+	body := map[string]string{
+		"role_id":   b.roleID,
+		"secret_id": b.secretID,
+	}
+	var ar authResponse
+	if err := b.send("POST", "auth/approle/login", "", body, &ar); err != nil {
+		return "", fmt.Errorf("error logging in with AppRole: %v", err)
+	}
+	if ar.Auth == nil || ar.Auth.ClientToken == "" {
+		return "", fmt.Errorf("AppRole login did not return token")
+	}
+	b.token = ar.Auth.ClientToken
+	if ar.Auth.LeaseDuration > 0 {
+		b.tokenExpiry = time.Now().Add(time.Duration(ar.Auth.LeaseDuration) * time.Second)
+	} else {
+		b.tokenExpiry = time.Now().AddDate(100, 0, 0)
+	}
+	return b.token, nil
+}
+
+// renewedToken renews token when half of its TTL has passed. Failed renewal
+// is retried after a minute and token is used as long as Vault accepts it.
+// https://developer.hashicorp.com/vault/api-docs/auth/token#renew-a-token-self
+func (b *VaultBackend) renewedToken() string {
+	if time.Now().Before(b.tokenExpiry) {
+		return b.token
+	}
+	var ar authResponse
+	if err := b.send("POST", "auth/token/renew-self", b.token, nil, &ar); err != nil || ar.Auth == nil {
+		b.tokenExpiry = time.Now().Add(time.Minute)
+		return b.token
+	}
+	if ttl := time.Duration(ar.Auth.LeaseDuration) * time.Second; ttl > 0 {
+		b.tokenExpiry = time.Now().Add(ttl / 2)
+	} else {
+		b.tokenExpiry = time.Now().AddDate(100, 0, 0)
+	}
+	return b.token
+}
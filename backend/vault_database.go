@@ -0,0 +1,177 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DatabasePrefix is prepended to Vault database secrets engine role names to
+// separate them from KV secrets.
+const DatabasePrefix = "database."
+
+// vaultLease is exported to JSON so leases can be restored after restart.
+type vaultLease struct {
+	ID        string
+	Data      map[string]string
+	TTL       time.Duration
+	IssuedAt  time.Time
+	RenewAt   time.Time
+	ExpiresAt time.Time
+	Renewable bool
+}
+
+type leaseResponse struct {
+	LeaseID       string            `json:"lease_id"`
+	LeaseDuration int               `json:"lease_duration"`
+	Renewable     bool              `json:"renewable"`
+	Data          map[string]string `json:"data"`
+}
+
+// EnableDatabaseCredentials serves dynamic credentials from database secrets
+// engine mounted to mountPath as volumes called database.<role>.
+func (b *VaultBackend) EnableDatabaseCredentials(mountPath string) {
+	b.databasePath = strings.Trim(mountPath, "/")
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/databases#generate-credentials
+func (b *VaultBackend) fetchDatabaseCredentials(role string) (*FetchSecretResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var renewErr error
+	lease := b.leases[role]
+	if lease != nil && time.Now().After(lease.RenewAt) {
+		// New credentials are issued when lease cannot be renewed anymore
+		if renewErr = b.renewLease(lease); renewErr != nil {
+			lease = nil
+		}
+	}
+	if lease == nil {
+		var lr leaseResponse
+		if err := b.do("GET", fmt.Sprintf("%s/creds/%s", b.databasePath, role), nil, &lr); err != nil {
+			if renewErr != nil {
+				return nil, fmt.Errorf("error generating credentials for role %s: %v (%v)", role, err, renewErr)
+			}
+			return nil, fmt.Errorf("error generating credentials for role %s: %v", role, err)
+		}
+		now := time.Now()
+		ttl := time.Duration(lr.LeaseDuration) * time.Second
+		lease = &vaultLease{
+			ID:        lr.LeaseID,
+			Data:      lr.Data,
+			TTL:       ttl,
+			IssuedAt:  now,
+			RenewAt:   now.Add(ttl / 2),
+			ExpiresAt: now.Add(ttl),
+			Renewable: lr.Renewable,
+		}
+		b.leases[role] = lease
+	}
+
+	return &FetchSecretResponse{
+		Fields:    lease.Data,
+		UpdatedAt: lease.IssuedAt,
+		ExpiresAt: lease.ExpiresAt,
+		RefreshAt: lease.RenewAt,
+	}, nil
+}
+
+// https://developer.hashicorp.com/vault/api-docs/system/leases#renew-lease
+func (b *VaultBackend) renewLease(lease *vaultLease) error {
+	if !lease.Renewable {
+		return fmt.Errorf("lease %s is not renewable", lease.ID)
+	}
+	body := map[string]interface{}{
+		"lease_id":  lease.ID,
+		"increment": int(lease.TTL.Seconds()),
+	}
+	var lr leaseResponse
+	if err := b.do("PUT", "sys/leases/renew", body, &lr); err != nil {
+		return fmt.Errorf("error renewing lease %s: %v", lease.ID, err)
+	}
+
+	// Lease is close to its max TTL when Vault does not extend it anymore.
+	// Old credentials stay valid until expiry so applications have time to
+	// switch to new ones.
+	ttl := time.Duration(lr.LeaseDuration) * time.Second
+	if ttl < lease.TTL/2 {
+		return fmt.Errorf("lease %s reached its max TTL", lease.ID)
+	}
+	now := time.Now()
+	lease.RenewAt = now.Add(ttl / 2)
+	lease.ExpiresAt = now.Add(ttl)
+	return nil
+}
+
+// https://developer.hashicorp.com/vault/api-docs/system/leases#revoke-lease
+func (b *VaultBackend) revokeDatabaseCredentials(role string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lease := b.leases[role]
+	if lease == nil {
+		return nil
+	}
+	delete(b.leases, role)
+	if err := b.do("PUT", "sys/leases/revoke", map[string]string{"lease_id": lease.ID}, nil); err != nil {
+		return fmt.Errorf("error revoking lease %s: %v", lease.ID, err)
+	}
+	return nil
+}
+
+// Leases returns leases of issued credentials so they can be restored with
+// RestoreLeases after restart and renewed or revoked.
+func (b *VaultBackend) Leases() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return json.Marshal(b.leases)
+}
+
+// RestoreLeases restores leases returned by Leases.
+func (b *VaultBackend) RestoreLeases(data []byte) error {
+	leases := make(map[string]*vaultLease)
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("error decoding leases: %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for role, lease := range leases {
+		if time.Now().Before(lease.ExpiresAt) {
+			b.leases[role] = lease
+		}
+	}
+	return nil
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/databases#list-roles
+func (b *VaultBackend) listDatabaseRoles() ([]string, error) {
+	var lkr listKeysResponse
+	if err := b.do("LIST", b.databasePath+"/roles", nil, &lkr); err != nil {
+		if err == errVaultNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing database roles: %v", err)
+	}
+	var names []string
+	for _, role := range lkr.Data.Keys {
+		names = append(names, DatabasePrefix+role)
+	}
+	return names, nil
+}
+
+// ReleaseSecret revokes dynamic credentials once no container uses them.
+func (b *VaultBackend) ReleaseSecret(secretName string) error {
+	if role, ok := b.databaseRole(secretName); ok {
+		return b.revokeDatabaseCredentials(role)
+	}
+	return nil
+}
+
+func (b *VaultBackend) databaseRole(secretName string) (string, bool) {
+	if b.databasePath == "" || !strings.HasPrefix(secretName, DatabasePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(secretName, DatabasePrefix), true
+}
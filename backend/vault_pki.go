@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PKIPrefix is prepended to Vault PKI secrets engine role names to separate
+// them from KV secrets.
+const PKIPrefix = "pki."
+
+type vaultCertificate struct {
+	files     map[string]string
+	notBefore time.Time
+	notAfter  time.Time
+	renewAt   time.Time
+}
+
+type issueResponse struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+// EnablePKI serves certificates issued by PKI secrets engine mounted to
+// mountPath as volumes called pki.<role>. Certificates are re-issued after
+// renewFraction of their lifetime has passed.
+func (b *VaultBackend) EnablePKI(mountPath, commonName, ttl string, renewFraction float64) {
+	b.pkiPath = strings.Trim(mountPath, "/")
+	b.pkiCommonName = commonName
+	b.pkiTTL = ttl
+	b.pkiRenewFraction = renewFraction
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/pki#generate-certificate-and-key
+func (b *VaultBackend) fetchCertificate(role string) (*FetchSecretResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cert := b.certs[role]
+	if cert == nil || time.Now().After(cert.renewAt) {
+		body := map[string]string{
+			"common_name": b.pkiCommonName,
+		}
+		if b.pkiTTL != "" {
+			body["ttl"] = b.pkiTTL
+		}
+		var ir issueResponse
+		if err := b.do("PUT", fmt.Sprintf("%s/issue/%s", b.pkiPath, role), body, &ir); err != nil {
+			return nil, fmt.Errorf("error issuing certificate for role %s: %v", role, err)
+		}
+
+		block, _ := pem.Decode([]byte(ir.Data.Certificate))
+		if block == nil {
+			return nil, fmt.Errorf("error decoding certificate issued for role %s", role)
+		}
+		x, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate issued for role %s: %v", role, err)
+		}
+		chain := ir.Data.CAChain
+		if len(chain) == 0 && ir.Data.IssuingCA != "" {
+			chain = []string{ir.Data.IssuingCA}
+		}
+		lifetime := x.NotAfter.Sub(x.NotBefore)
+		cert = &vaultCertificate{
+			files: map[string]string{
+				"cert.pem":  pemFile(ir.Data.Certificate),
+				"key.pem":   pemFile(ir.Data.PrivateKey),
+				"chain.pem": pemFile(chain...),
+			},
+			notBefore: x.NotBefore,
+			notAfter:  x.NotAfter,
+			renewAt:   x.NotBefore.Add(time.Duration(float64(lifetime) * b.pkiRenewFraction)),
+		}
+		b.certs[role] = cert
+	}
+
+	return &FetchSecretResponse{
+		Files:     cert.files,
+		UpdatedAt: cert.notBefore,
+		ExpiresAt: cert.notAfter,
+		RefreshAt: cert.renewAt,
+	}, nil
+}
+
+// https://developer.hashicorp.com/vault/api-docs/secret/pki#list-roles
+func (b *VaultBackend) listPKIRoles() ([]string, error) {
+	var lkr listKeysResponse
+	if err := b.do("LIST", b.pkiPath+"/roles", nil, &lkr); err != nil {
+		if err == errVaultNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error listing PKI roles: %v", err)
+	}
+	var names []string
+	for _, role := range lkr.Data.Keys {
+		names = append(names, PKIPrefix+role)
+	}
+	return names, nil
+}
+
+func (b *VaultBackend) pkiRole(secretName string) (string, bool) {
+	if b.pkiPath == "" || !strings.HasPrefix(secretName, PKIPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(secretName, PKIPrefix), true
+}
+
+// pemFile joins PEM blocks to one file content.
+func pemFile(blocks ...string) string {
+	var sb strings.Builder
+	for _, b := range blocks {
+		sb.WriteString(strings.TrimSpace(b))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+// bundleInfo defines secrets of bundle volume, either explicitly or by
+// name pattern or prefix of listed secrets.
+type bundleInfo struct {
+	Secrets []string
+	Pattern string
+	Prefix  string
+}
+
+// batchFetcher is implemented by backends which can fetch many secrets with
+// fewer requests than one per secret.
+type batchFetcher interface {
+	FetchSecrets(secretNames []string, reason string) (map[string]*backend.FetchSecretResponse, error)
+}
+
+// secretNames returns names of secrets in bundle.
+func (d *VolumeDriver) secretNames(b *bundleInfo) ([]string, error) {
+	if len(b.Secrets) > 0 {
+		return b.Secrets, nil
+	}
+	listed, err := d.backend.ListSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("error listing secrets: %v", err)
+	}
+	var names []string
+	for _, name := range listed {
+		if b.Prefix != "" && strings.HasPrefix(name, b.Prefix) {
+			names = append(names, name)
+		}
+		if b.Pattern != "" {
+			if ok, _ := path.Match(b.Pattern, name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no secrets match to bundle")
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// fetchBundle fetches all secrets of bundle and returns them as one secret
+// having file per secret.
+func (d *VolumeDriver) fetchBundle(volumeName string, b *bundleInfo) (*backend.FetchSecretResponse, error) {
+	names, err := d.secretNames(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]*backend.FetchSecretResponse
+	if fetcher, ok := d.backend.(batchFetcher); ok {
+		if secrets, err = fetcher.FetchSecrets(names, auditReason(volumeName)); err != nil {
+			return nil, err
+		}
+		for name, secret := range secrets {
+			if secrets[name], err = d.decrypt(name, secret); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		secrets = make(map[string]*backend.FetchSecretResponse, len(names))
+		for _, name := range names {
+			if secrets[name], err = d.fetchSecret(volumeName, name); err != nil {
+				return nil, fmt.Errorf("error fetching secret %s: %w", name, err)
+			}
+		}
+	}
+
+	bundle := &backend.FetchSecretResponse{
+		Files: make(map[string]string, len(names)),
+	}
+	for _, name := range names {
+		secret, ok := secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("secret %s not found", name)
+		}
+		value, err := secret.Field("")
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret %s: %v", name, err)
+		}
+		file := bundleFileName(name, b.Prefix)
+		if _, exists := bundle.Files[file]; exists {
+			return nil, fmt.Errorf("secrets of bundle have conflicting file name %s", file)
+		}
+		bundle.Files[file] = value
+		mergeTimes(bundle, secret)
+	}
+	if err := checkFileNames(bundle.Files); err != nil {
+		return nil, fmt.Errorf("secrets of bundle cannot be written to files: %v", err)
+	}
+	return bundle, nil
+}
+
+// mergeTimes updates timestamps of secret combined from many secrets. It is
+// updated when any of them is and expires and must be refreshed as soon as
+// first of them.
+func mergeTimes(dst, src *backend.FetchSecretResponse) {
+	if src.UpdatedAt.After(dst.UpdatedAt) {
+		dst.UpdatedAt = src.UpdatedAt
+	}
+	if !src.ExpiresAt.IsZero() && (dst.ExpiresAt.IsZero() || src.ExpiresAt.Before(dst.ExpiresAt)) {
+		dst.ExpiresAt = src.ExpiresAt
+	}
+	if !src.RefreshAt.IsZero() && (dst.RefreshAt.IsZero() || src.RefreshAt.Before(dst.RefreshAt)) {
+		dst.RefreshAt = src.RefreshAt
+	}
+}
+
+// bundleFileName returns name of file for secret in bundle. Prefix shared
+// by all secrets is left out and path separators are replaced.
+func bundleFileName(secretName, prefix string) string {
+	name := strings.TrimPrefix(secretName, prefix)
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+}
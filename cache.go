@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+// cacheDir keeps encrypted copies of last fetched secrets. It cannot clash
+// with volume names because those must start with letter or number.
+const cacheDir = ".cache"
+
+type cacheEntry struct {
+	FetchedAt time.Time
+	Secret    *backend.FetchSecretResponse
+}
+
+func cachePath(volumeName string) string {
+	return filepath.Join(baseDir, cacheDir, volumeName)
+}
+
+// saveCache stores secret of volume encrypted to disk when offline cache is
+// enabled.
+func (d *VolumeDriver) saveCache(volumeName string, secret *backend.FetchSecretResponse) {
+	if d.cacheMaxAge == 0 {
+		return
+	}
+	data, err := json.Marshal(cacheEntry{
+		FetchedAt: time.Now(),
+		Secret:    secret,
+	})
+	if err == nil {
+		if err = os.MkdirAll(filepath.Join(baseDir, cacheDir), 0700); err == nil {
+			err = writeSealed(cachePath(volumeName), data)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to cache secret of volume %s: %v", volumeName, err)
+	}
+}
+
+// cachedSecret returns last secret fetched for volume and the time it was
+// fetched, when fetching it from backend failed and cached copy is not older
+// than maxAge. Secrets which backend refuses to serve, e.g. disabled ones,
+// are never served from cache.
+func (d *VolumeDriver) cachedSecret(volumeName string, fetchErr error, maxAge time.Duration) (*backend.FetchSecretResponse, time.Time) {
+	var unavailable *backend.UnavailableError
+	if maxAge == 0 || errors.As(fetchErr, &unavailable) {
+		return nil, time.Time{}
+	}
+	data, err := readSealed(cachePath(volumeName))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Failed to read cached secret of volume %s: %v", volumeName, err)
+		}
+		return nil, time.Time{}
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Secret == nil {
+		log.Errorf("Failed to decode cached secret of volume %s: %v", volumeName, err)
+		return nil, time.Time{}
+	}
+	age := time.Since(entry.FetchedAt)
+	if age > maxAge {
+		log.Errorf("Cached secret of volume %s is too old to be used (%s)", volumeName, age.Round(time.Second))
+		return nil, time.Time{}
+	}
+
+	log.Warnf("WARNING: Using cached secret of volume %s fetched %s ago because fetching it failed: %v",
+		volumeName, age.Round(time.Second), fetchErr)
+	// Retry fetching from backend on next refresh
+	secret := *entry.Secret
+	secret.RefreshAt = time.Now()
+	return &secret, entry.FetchedAt
+}
+
+func removeCache(volumeName string) {
+	if err := os.Remove(cachePath(volumeName)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove cached secret of volume %s: %v", volumeName, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+// Formats which render all fields of secret to one file.
+const (
+	formatDotenv     = "dotenv"
+	formatJSON       = "json"
+	formatYAML       = "yaml"
+	formatProperties = "properties"
+)
+
+var (
+	formats     = []string{formatDotenv, formatJSON, formatYAML, formatProperties}
+	invalidEnvR = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// formatSecret renders fields of secret in given format. Bundles are
+// rendered with field per secret and single value secrets with field named
+// by volume.
+func formatSecret(format, volumeName string, secret *backend.FetchSecretResponse) (*backend.FetchSecretResponse, error) {
+	fields := secret.Fields
+	if len(fields) == 0 {
+		fields = secret.Files
+	}
+	if len(fields) == 0 {
+		fields = map[string]string{volumeName: secret.Value}
+	}
+
+	var value string
+	var err error
+	switch format {
+	case formatDotenv:
+		value, err = formatDotenvFile(fields)
+	case formatJSON:
+		var data []byte
+		data, err = json.MarshalIndent(fields, "", "  ")
+		value = string(data) + "\n"
+	case formatYAML:
+		value = formatYAMLFile(fields)
+	case formatProperties:
+		value = formatPropertiesFile(fields)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &backend.FetchSecretResponse{
+		Value:     value,
+		UpdatedAt: secret.UpdatedAt,
+		ExpiresAt: secret.ExpiresAt,
+		RefreshAt: secret.RefreshAt,
+	}, nil
+}
+
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// formatDotenvFile writes fields as KEY="value" lines. Characters which are
+// not valid in variable names are replaced with _ and values are double
+// quoted with backslash escapes.
+func formatDotenvFile(fields map[string]string) (string, error) {
+	var sb strings.Builder
+	seen := make(map[string]string, len(fields))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`", "\n", `\n`, "\r", `\r`)
+	for _, k := range sortedKeys(fields) {
+		name := invalidEnvR.ReplaceAllString(k, "_")
+		if name == "" || (name[0] >= '0' && name[0] <= '9') {
+			name = "_" + name
+		}
+		if other, ok := seen[name]; ok {
+			return "", fmt.Errorf("fields %s and %s have same variable name %s", other, k, name)
+		}
+		seen[name] = k
+		fmt.Fprintf(&sb, "%s=\"%s\"\n", name, escaper.Replace(fields[k]))
+	}
+	return sb.String(), nil
+}
+
+// formatYAMLFile writes fields as YAML map. JSON strings are valid YAML
+// double quoted scalars so keys and values are encoded as those.
+func formatYAMLFile(fields map[string]string) string {
+	var sb strings.Builder
+	for _, k := range sortedKeys(fields) {
+		key, _ := json.Marshal(k)
+		value, _ := json.Marshal(fields[k])
+		fmt.Fprintf(&sb, "%s: %s\n", key, value)
+	}
+	return sb.String()
+}
+
+// formatPropertiesFile writes fields as Java .properties file escaped same
+// way as java.util.Properties.store does.
+func formatPropertiesFile(fields map[string]string) string {
+	var sb strings.Builder
+	for _, k := range sortedKeys(fields) {
+		sb.WriteString(escapeProperty(k, true))
+		sb.WriteByte('=')
+		sb.WriteString(escapeProperty(fields[k], false))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func escapeProperty(s string, isKey bool) string {
+	var sb strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\f':
+			sb.WriteString(`\f`)
+		case r == ' ' && (isKey || i == 0):
+			sb.WriteString(`\ `)
+		case strings.ContainsRune("=:#!", r):
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			// Properties files are ISO-8859-1 encoded
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&sb, `\u%04X`, u)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
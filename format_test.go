@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+func TestFormatDotenvFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "sorted keys",
+			fields: map[string]string{"USER": "app", "PASSWORD": "pw"},
+			want:   "PASSWORD=\"pw\"\nUSER=\"app\"\n",
+		},
+		{
+			name:   "escaped value",
+			fields: map[string]string{"V": "a\"b\\c$d`e\nf\rg"},
+			want:   `V="a\"b\\c\$d\` + "`" + `e\nf\rg"` + "\n",
+		},
+		{
+			name:   "invalid characters in name",
+			fields: map[string]string{"db.host-name": "x"},
+			want:   "db_host_name=\"x\"\n",
+		},
+		{
+			name:   "name starting with digit",
+			fields: map[string]string{"1st": "x"},
+			want:   "_1st=\"x\"\n",
+		},
+		{
+			name:    "conflicting names",
+			fields:  map[string]string{"a.b": "1", "a-b": "2"},
+			wantErr: "same variable name a_b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatDotenvFile(tt.fields)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatYAMLFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   string
+	}{
+		{
+			name:   "plain",
+			fields: map[string]string{"user": "app", "password": "pw"},
+			want:   "\"password\": \"pw\"\n\"user\": \"app\"\n",
+		},
+		{
+			name:   "special characters",
+			fields: map[string]string{"a: b": "x\n\"y\"\t#z"},
+			want:   "\"a: b\": \"x\\n\\\"y\\\"\\t#z\"\n",
+		},
+		{
+			name:   "values looking like other types",
+			fields: map[string]string{"on": "yes", "n": "null", "v": "1.0"},
+			want:   "\"n\": \"null\"\n\"on\": \"yes\"\n\"v\": \"1.0\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatYAMLFile(tt.fields); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatPropertiesFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   string
+	}{
+		{
+			name:   "plain",
+			fields: map[string]string{"db.user": "app"},
+			want:   "db.user=app\n",
+		},
+		{
+			name:   "separators and comments",
+			fields: map[string]string{"a=b:c": "#x!y=z"},
+			want:   `a\=b\:c=\#x\!y\=z` + "\n",
+		},
+		{
+			name:   "spaces",
+			fields: map[string]string{"a b": " x y"},
+			want:   `a\ b=\ x y` + "\n",
+		},
+		{
+			name:   "control characters",
+			fields: map[string]string{"k": "a\\b\tc\nd\re\ff"},
+			want:   `k=a\\b\tc\nd\re\ff` + "\n",
+		},
+		{
+			name:   "non-ASCII",
+			fields: map[string]string{"k": "é😀"},
+			want:   `k=\u00E9\uD83D\uDE00` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatPropertiesFile(tt.fields); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		secret  *backend.FetchSecretResponse
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "fields",
+			format: formatDotenv,
+			secret: &backend.FetchSecretResponse{Fields: map[string]string{"user": "app"}},
+			want:   "user=\"app\"\n",
+		},
+		{
+			name:   "bundle files",
+			format: formatJSON,
+			secret: &backend.FetchSecretResponse{Files: map[string]string{"a": "1", "b": "2"}},
+			want:   "{\n  \"a\": \"1\",\n  \"b\": \"2\"\n}\n",
+		},
+		{
+			name:   "single value named by volume",
+			format: formatProperties,
+			secret: &backend.FetchSecretResponse{Value: "pw"},
+			want:   "vol=pw\n",
+		},
+		{
+			name:    "unknown format",
+			format:  "toml",
+			secret:  &backend.FetchSecretResponse{Value: "pw"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatSecret(tt.format, "vol", tt.secret)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("got %q, want %q", got.Value, tt.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/hectane/go-acl v0.0.0-20230122075934-ca0b05cb1adb
 	github.com/sirupsen/logrus v1.9.3
 	golang.org/x/sys v0.33.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
 )
 
 require (
@@ -18,6 +19,7 @@ require (
 	github.com/docker/go-connections v0.5.0 // indirect
 	github.com/pmezard/go-difflib v1.0.1-0.20181226105442-5d4384ee4fb2 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
 )
 
 replace github.com/docker/go-plugins-helpers v0.0.0-20240701071450-45e2431495c8 => github.com/olljanat/go-plugins-helpers v0.0.0-20250515164337-e76ac885ec0e
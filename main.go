@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,8 +25,26 @@ import (
 
 const (
 	refreshInterval = 1 * time.Hour
+	mountedInterval = 1 * time.Minute
 	dbFile          = "secrets.json"
+	dbVersion       = 2
+	keyFile         = "secrets.key"
+	credentialFile  = "vault-credential"
+	leaseFile       = "vault-leases"
 	npipeMaxBuf     = 4096
+	defaultFileMode = 0644
+	layoutDirectory = "directory"
+)
+
+// Mount policies which tell when volume can be mounted after fetching its
+// secret failed.
+const (
+	// mountStrict fails mount on any error
+	mountStrict = "strict"
+	// mountCached allows using earlier secret file or offline cache
+	mountCached = "cached"
+	// mountStale allows using earlier secret which is not too old
+	mountStale = "stale"
 )
 
 var (
@@ -26,6 +52,9 @@ var (
 	log         = logger()
 	validName   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
 	Version     string
+
+	// stateFiles are files of plugin state stored to baseDir
+	stateFiles = []string{dbFile, dbFile + ".tmp", keyFile, credentialFile, leaseFile, policyFile}
 )
 
 type SecretBackend interface {
@@ -33,36 +62,118 @@ type SecretBackend interface {
 	ListSecrets() ([]string, error)
 }
 
+// secretReleaser is implemented by backends which hand out short-lived
+// credentials that should be revoked when no container uses them anymore.
+type secretReleaser interface {
+	ReleaseSecret(secretName string) error
+}
+
+// leaseKeeper is implemented by backends which hold leases of issued
+// credentials. Leases are stored so they can be renewed and revoked after
+// restart.
+type leaseKeeper interface {
+	Leases() ([]byte, error)
+	RestoreLeases(data []byte) error
+}
+
+// secretResolver is implemented by backends which serve volumes not listed
+// by ListSecrets, e.g. pinned versions of listed secrets.
+type secretResolver interface {
+	ResolveSecret(volumeName string) (secretName string, ok bool)
+}
+
+// auditedFetcher is implemented by backends which record the reason of each
+// access to their audit trail.
+type auditedFetcher interface {
+	FetchSecretAudited(secretName, reason string) (*backend.FetchSecretResponse, error)
+}
+
+// versionHistory is implemented by backends which keep track of secret
+// versions. Versions are shown in volume status.
+type versionHistory interface {
+	VersionHistory(secretName string) []string
+}
+
 type volumeInfo struct {
 	SecretName string
+	Field      string
 	UpdatedAt  time.Time
 	ExpiresAt  time.Time
-	Valid      bool
+	RefreshAt  time.Time
+	// FetchedAt tells when secret on disk was fetched from backend
+	FetchedAt time.Time
+	// Valid tells if secret name is usable as volume name and Disabled that
+	// backend does not list the secret anymore, e.g. because it is disabled.
+	Valid    bool
+	Disabled bool
+	// Alias is set for volumes created with driver options. Those map
+	// freely named volumes to secrets and can be removed.
+	Alias    bool
+	UID      *int
+	GID      *int
+	Mode     os.FileMode
+	DirMode  os.FileMode
+	Layout   string
+	Bundle   *bundleInfo
+	Template *templateInfo
+	Format   string
 }
 
 type VolumeDriver struct {
 	volumes map[string]*volumeInfo
+	mounts  map[string]map[string]struct{}
 	backend SecretBackend
-	mu      sync.RWMutex
+	// transit decrypts secrets stored encrypted to backend when set
+	transit *backend.TransitDecrypter
+	policy  []policyRule
+	// cacheMaxAge enables offline cache when set
+	cacheMaxAge time.Duration
+	mountPolicy string
+	maxStale    time.Duration
+	mu          sync.RWMutex
 }
 
 type simpleFormatter struct{}
 
-func NewVolumeDriver(backend SecretBackend) *VolumeDriver {
+func NewVolumeDriver(backend SecretBackend, transit *backend.TransitDecrypter, policy []policyRule, cacheMaxAge time.Duration, mountPolicy string, maxStale time.Duration) *VolumeDriver {
 	d := &VolumeDriver{
-		volumes: make(map[string]*volumeInfo),
-		backend: backend,
+		volumes:     make(map[string]*volumeInfo),
+		mounts:      make(map[string]map[string]struct{}),
+		backend:     backend,
+		transit:     transit,
+		policy:      policy,
+		cacheMaxAge: cacheMaxAge,
+		mountPolicy: mountPolicy,
+		maxStale:    maxStale,
 	}
 
-	if err := d.loadDB(); err != nil {
+	if version, err := d.loadDB(); err != nil {
 		log.Errorf("Failed to read database from disk: %v", err)
+	} else if version < dbVersion {
+		d.migrateDB(version)
 	}
+	d.loadLeases()
 
 	// Disabled for now and refreshing secret in Mount() instead of.
 	// go d.startSecretRefresh()
+	go d.startMountedRefresh()
 	return d
 }
 
+// validVolumeName tells if name can be used as volume name. On Windows
+// secrets are stored next to plugin state so its file names are reserved.
+func validVolumeName(name string) bool {
+	if !validName.MatchString(name) {
+		return false
+	}
+	return volumesDir != baseDir || !slices.Contains(stateFiles, name)
+}
+
+// volumePath returns path of secret file or directory of volume.
+func volumePath(volumeName string) string {
+	return filepath.Join(volumesDir, volumeName)
+}
+
 func (d *VolumeDriver) startSecretRefresh() {
 	ticker := time.NewTicker(refreshInterval)
 	defer ticker.Stop()
@@ -70,7 +181,7 @@ func (d *VolumeDriver) startSecretRefresh() {
 	for range ticker.C {
 		for name, vol := range d.volumes {
 			d.mu.Lock()
-			if err := d.updateSecretFile(name, vol, false); err != nil {
+			if err := d.updateSecretFile(name, vol, false, d.cacheMaxAge); err != nil {
 				log.Errorf("Failed to update secret for volume %s: %v", name, err)
 			}
 			d.mu.Unlock()
@@ -81,32 +192,329 @@ func (d *VolumeDriver) startSecretRefresh() {
 	}
 }
 
-func (d *VolumeDriver) updateSecretFile(volumeName string, vol *volumeInfo, add bool) error {
-	secretFile := filepath.Join(baseDir, volumeName)
-	if _, err := os.Stat(secretFile); os.IsNotExist(err) && !add {
+// startMountedRefresh keeps secrets which must be refreshed while mounted,
+// e.g. leased credentials, up to date. Bundles and templates are refreshed
+// every refreshInterval so they pick up changes of the secrets they combine.
+func (d *VolumeDriver) startMountedRefresh() {
+	ticker := time.NewTicker(mountedInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.mu.RLock()
+		due := make(map[string]volumeInfo)
+		for name := range d.mounts {
+			if vol := d.volumes[name]; vol != nil && d.refreshDue(vol) {
+				due[name] = *vol
+			}
+		}
+		d.mu.RUnlock()
+
+		// Secrets are fetched without lock so other calls are not blocked
+		for name, v := range due {
+			secret, fetchedAt, err := d.loadSecret(name, &v, d.cacheMaxAge)
+			if err == nil {
+				d.mu.Lock()
+				// Volume might have been unmounted meanwhile
+				if vol := d.volumes[name]; vol != nil && len(d.mounts[name]) > 0 {
+					err = d.writeVolume(name, vol, secret, fetchedAt)
+				} else {
+					d.releaseUnmounted(v.SecretName)
+				}
+				d.mu.Unlock()
+			}
+			if err != nil {
+				log.Errorf("Failed to refresh secret for volume %s: %v", name, err)
+			}
+		}
+	}
+}
+
+// refreshDue tells if mounted volume must be refreshed.
+func (d *VolumeDriver) refreshDue(vol *volumeInfo) bool {
+	if !vol.RefreshAt.IsZero() && !time.Now().Before(vol.RefreshAt) {
+		return true
+	}
+	return (vol.Bundle != nil || vol.Template != nil) && time.Since(vol.FetchedAt) >= refreshInterval
+}
+
+// updateSecretFile writes secret of volume to disk. When fetching secret
+// fails, offline cache not older than cacheMaxAge is used.
+func (d *VolumeDriver) updateSecretFile(volumeName string, vol *volumeInfo, add bool, cacheMaxAge time.Duration) error {
+	if _, err := os.Stat(volumePath(volumeName)); os.IsNotExist(err) && !add {
 		return nil
 	}
+	secret, fetchedAt, err := d.loadSecret(volumeName, vol, cacheMaxAge)
+	if err != nil {
+		return err
+	}
+	return d.writeVolume(volumeName, vol, secret, fetchedAt)
+}
 
-	secret, err := d.backend.FetchSecret(vol.SecretName)
+// loadSecret fetches secret of volume. When fetching fails, offline cache not
+// older than cacheMaxAge is used. It returns also the time when secret was
+// fetched from backend.
+func (d *VolumeDriver) loadSecret(volumeName string, vol *volumeInfo, cacheMaxAge time.Duration) (*backend.FetchSecretResponse, time.Time, error) {
+	fetchedAt := time.Now()
+	secret, err := d.fetchVolume(volumeName, vol)
 	if err != nil {
-		return fmt.Errorf("error fetching secret: %v", err)
+		secret, fetchedAt = d.cachedSecret(volumeName, err, cacheMaxAge)
+		if secret == nil {
+			return nil, time.Time{}, fmt.Errorf("error fetching secret: %w", err)
+		}
+	} else {
+		d.saveCache(volumeName, secret)
 	}
+	return secret, fetchedAt, nil
+}
 
-	if old, err := os.ReadFile(secretFile); err == nil && string(old) == secret.Value {
-		return nil
+// writeVolume writes secret to volume and stores its state.
+func (d *VolumeDriver) writeVolume(volumeName string, vol *volumeInfo, secret *backend.FetchSecretResponse, fetchedAt time.Time) error {
+	// Fetching might have issued or renewed leases
+	d.saveLeases()
+
+	secretFile := volumePath(volumeName)
+	var changed bool
+	var err error
+	isDir := len(secret.Files) > 0 && vol.Field == ""
+	// Directories of secrets with multiple files, e.g. certificates, are
+	// swapped atomically so key and certificate never mismatch
+	if vol.Layout == layoutDirectory || isDir && runtime.GOOS != "windows" {
+		var files map[string]string
+		if files, err = volumeFiles(volumeName, vol, secret); err != nil {
+			return fmt.Errorf("error reading secret %s: %v", vol.SecretName, err)
+		}
+		changed, err = writeAtomicDir(secretFile, files, d.filePerm(volumeName, vol))
+	} else if isDir {
+		changed, err = writeSecretDir(secretFile, secret.Files, d.filePerm(volumeName, vol))
+	} else {
+		var value string
+		if value, err = secret.Field(vol.Field); err != nil {
+			return fmt.Errorf("error reading secret %s: %v", vol.SecretName, err)
+		}
+		changed, err = writeSecretFile(secretFile, value, d.filePerm(volumeName, vol))
 	}
-	if err := os.WriteFile(secretFile, []byte(secret.Value), 0644); err != nil {
+	if err != nil {
 		return fmt.Errorf("error writing secret %s: %v", volumeName, err)
 	}
-	vol.UpdatedAt = secret.UpdatedAt
 	vol.ExpiresAt = secret.ExpiresAt
+	vol.RefreshAt = secret.RefreshAt
+	vol.FetchedAt = fetchedAt
+	if !changed {
+		d.saveDB()
+		return nil
+	}
+	vol.UpdatedAt = secret.UpdatedAt
 	d.saveDB()
 	log.Printf("Updated secret for volume %s", volumeName)
 	return nil
 }
 
+// fetchVolume fetches secret, bundle or template of volume and converts it
+// to the format of volume.
+func (d *VolumeDriver) fetchVolume(volumeName string, vol *volumeInfo) (*backend.FetchSecretResponse, error) {
+	var secret *backend.FetchSecretResponse
+	var err error
+	if vol.Bundle != nil {
+		secret, err = d.fetchBundle(volumeName, vol.Bundle)
+	} else if vol.Template != nil {
+		secret, err = d.renderTemplate(volumeName, vol.Template)
+	} else {
+		secret, err = d.fetchSecret(volumeName, vol.SecretName)
+	}
+	if err != nil || vol.Format == "" {
+		return secret, err
+	}
+	return formatSecret(vol.Format, volumeName, secret)
+}
+
+// volumeFiles returns files of directory layout volume. Without field
+// selection every field of secret is own file and secrets with single value
+// are written to file named by volume.
+func volumeFiles(volumeName string, vol *volumeInfo, secret *backend.FetchSecretResponse) (map[string]string, error) {
+	switch {
+	case vol.Field != "":
+		value, err := secret.Field(vol.Field)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{vol.Field: value}, nil
+	case len(secret.Files) > 0:
+		return secret.Files, nil
+	case len(secret.Fields) > 0:
+		return secret.Fields, nil
+	}
+	return map[string]string{volumeName: secret.Value}, nil
+}
+
+// fetchSecret fetches secret and tells to backends which audit accesses
+// which host and volume it is fetched for.
+func (d *VolumeDriver) fetchSecret(volumeName, secretName string) (*backend.FetchSecretResponse, error) {
+	var secret *backend.FetchSecretResponse
+	var err error
+	if fetcher, ok := d.backend.(auditedFetcher); ok {
+		secret, err = fetcher.FetchSecretAudited(secretName, auditReason(volumeName))
+	} else {
+		secret, err = d.backend.FetchSecret(secretName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.decrypt(secretName, secret)
+}
+
+// decrypt decrypts Vault Transit ciphertexts of secret when Transit is
+// configured.
+func (d *VolumeDriver) decrypt(secretName string, secret *backend.FetchSecretResponse) (*backend.FetchSecretResponse, error) {
+	if d.transit == nil {
+		return secret, nil
+	}
+	return d.transit.DecryptSecret(secretName, secret)
+}
+
+// auditReason tells which host and volume secret is accessed for.
+func auditReason(volumeName string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("docker-secretprovider-plugin on %s for volume %s", host, volumeName)
+}
+
+// Create registers alias volume for secret given with driver options, e.g.
+// docker volume create -d secret --opt secret=Prod/DB_Password app-db-pw
+// Without options volume must be one which the backend already serves.
 func (d *VolumeDriver) Create(r *volume.CreateRequest) error {
-	return fmt.Errorf("not implemented. Create secret to %s instead", backendType)
+	if len(r.Options) == 0 {
+		if _, err := d.Get(&volume.GetRequest{Name: r.Name}); err != nil {
+			return fmt.Errorf("secret %s not found. Create secret to %s or give it with --opt secret=<name>", r.Name, backendType)
+		}
+		return nil
+	}
+	if !validVolumeName(r.Name) {
+		return fmt.Errorf("invalid volume name %q. Must match [a-z0-9][a-z0-9_.-]* and not be one of %s", r.Name, strings.Join(stateFiles, ", "))
+	}
+
+	vol := &volumeInfo{
+		Valid: true,
+		Alias: true,
+	}
+	bundle := &bundleInfo{}
+	tmpl := &templateInfo{}
+	for k, v := range r.Options {
+		switch k {
+		case "secret":
+			vol.SecretName = v
+		case "secrets":
+			bundle.Secrets = nil
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					bundle.Secrets = append(bundle.Secrets, name)
+				}
+			}
+		case "pattern":
+			if _, err := path.Match(v, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", v, err)
+			}
+			bundle.Pattern = v
+		case "prefix":
+			bundle.Prefix = v
+		case "template":
+			tmpl.Text = v
+		case "template-secret":
+			tmpl.Secret = v
+		case "format":
+			if !slices.Contains(formats, v) {
+				return fmt.Errorf("invalid format %q, must be one of %s", v, strings.Join(formats, ", "))
+			}
+			vol.Format = v
+		case "field":
+			vol.Field = v
+		case "uid", "gid":
+			if runtime.GOOS == "windows" {
+				return fmt.Errorf("option %s is not supported on Windows", k)
+			}
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 0 {
+				return fmt.Errorf("invalid %s %q", k, v)
+			}
+			if k == "uid" {
+				vol.UID = &id
+			} else {
+				vol.GID = &id
+			}
+		case "mode", "dirmode":
+			mode, err := parseMode(v)
+			if err != nil {
+				return err
+			}
+			if k == "mode" {
+				vol.Mode = mode
+			} else {
+				vol.DirMode = mode
+			}
+		case "layout":
+			switch v {
+			case "file":
+			case layoutDirectory:
+				// Swapping ..data symlink relies on POSIX rename
+				if runtime.GOOS == "windows" {
+					return fmt.Errorf("layout %s is not supported on Windows", v)
+				}
+				vol.Layout = v
+			default:
+				return fmt.Errorf("invalid layout %q, must be file or %s", v, layoutDirectory)
+			}
+		default:
+			return fmt.Errorf("unknown option %q", k)
+		}
+	}
+	isBundle := bundle.Secrets != nil || bundle.Pattern != "" || bundle.Prefix != ""
+	isTemplate := tmpl.Text != "" || tmpl.Secret != ""
+	switch {
+	case isBundle && isTemplate, tmpl.Text != "" && tmpl.Secret != "":
+		return fmt.Errorf("only one of options secrets, pattern, prefix, template and template-secret can be used")
+	case isBundle || isTemplate:
+		if vol.SecretName != "" || vol.Field != "" {
+			return fmt.Errorf("options secret and field cannot be used with bundles and templates")
+		}
+		if isBundle {
+			vol.Bundle = bundle
+		} else {
+			vol.Template = tmpl
+		}
+	case vol.SecretName == "":
+		return fmt.Errorf("option secret, secrets, pattern, prefix, template or template-secret is required")
+	}
+	if vol.Format != "" && (vol.Field != "" || vol.Template != nil) {
+		return fmt.Errorf("option format cannot be used with field and templates")
+	}
+
+	// Fail early when secret or field does not exist
+	secret, err := d.fetchVolume(r.Name, vol)
+	if err != nil {
+		return fmt.Errorf("error fetching secret: %v", err)
+	}
+	if vol.Layout == layoutDirectory {
+		_, err = volumeFiles(r.Name, vol, secret)
+	} else if len(secret.Files) == 0 || vol.Field != "" {
+		_, err = secret.Field(vol.Field)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.releaseUnmounted(vol.SecretName)
+	if err != nil {
+		return fmt.Errorf("error reading secret %s: %v", vol.SecretName, err)
+	}
+	if old, exists := d.volumes[r.Name]; exists {
+		// Creating same volume again is fine
+		o := *old
+		o.UpdatedAt, o.ExpiresAt, o.RefreshAt, o.FetchedAt, o.Valid = vol.UpdatedAt, vol.ExpiresAt, vol.RefreshAt, vol.FetchedAt, vol.Valid
+		if o.Alias && reflect.DeepEqual(&o, vol) {
+			return nil
+		}
+		return fmt.Errorf("volume %s already exists", r.Name)
+	}
+	d.volumes[r.Name] = vol
+	d.saveDB()
+	return nil
 }
 
 func (d *VolumeDriver) List() (*volume.ListResponse, error) {
@@ -115,30 +523,38 @@ func (d *VolumeDriver) List() (*volume.ListResponse, error) {
 		log.Errorf("Failed to list secrets: %v", err)
 	}
 
-	d.mu.RLock()
-	volumes := d.volumes
-	d.mu.RUnlock()
-
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	for _, name := range names {
-		valid := true
-		if _, exists := volumes[name]; !exists {
-			if !validName.MatchString(name) {
-				log.Warnf("Skipping invalid secret with name %q. Must match [a-z0-9][a-z0-9_.-]*", name)
-				valid = false
+		if _, exists := d.volumes[name]; !exists {
+			valid := validVolumeName(name)
+			if !valid {
+				log.Warnf("Skipping invalid secret with name %q. Must match [a-z0-9][a-z0-9_.-]* and not be one of %s", name, strings.Join(stateFiles, ", "))
 			}
-			d.mu.Lock()
-			volumes[name] = &volumeInfo{
+			d.volumes[name] = &volumeInfo{
 				SecretName: name,
-				UpdatedAt:  time.Time{},
 				Valid:      valid,
 			}
-			d.mu.Unlock()
 		}
 	}
+
+	// Hide secrets which backend does not list anymore, e.g. disabled ones
+	if err == nil {
+		listed := make(map[string]bool, len(names))
+		for _, name := range names {
+			listed[name] = true
+		}
+		for name, v := range d.volumes {
+			if v.SecretName == name && v.Field == "" && !v.Alias {
+				v.Valid = validVolumeName(name)
+				v.Disabled = !listed[name]
+			}
+		}
+	}
+
 	var vols []*volume.Volume
-	for name := range volumes {
-		v := volumes[name]
-		if v.Valid {
+	for name, v := range d.volumes {
+		if d.available(v) {
 			vols = append(vols, &volume.Volume{Name: name})
 		}
 	}
@@ -155,77 +571,326 @@ func (d *VolumeDriver) List() (*volume.ListResponse, error) {
 	return resp, nil
 }
 
-func (d *VolumeDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+// volume returns volume by name.
+func (d *VolumeDriver) volume(name string) (*volumeInfo, bool) {
 	d.mu.RLock()
-	volumes := d.volumes
-	d.mu.RUnlock()
+	defer d.mu.RUnlock()
+	vol, exists := d.volumes[name]
+	return vol, exists
+}
 
-	vol, exists := volumes[r.Name]
+// available tells if volume can be listed and mounted. Volumes exposing
+// field of a secret and alias volumes follow the secret they use, which
+// itself might not have valid volume name.
+func (d *VolumeDriver) available(vol *volumeInfo) bool {
+	if !vol.Valid || vol.Disabled {
+		return false
+	}
+	parent, exists := d.volumes[vol.SecretName]
+	return !exists || !parent.Disabled
+}
+
+func (d *VolumeDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
+	vol, exists := d.volume(r.Name)
 	if !exists {
 		d.List()
-		vol, exists = volumes[r.Name]
+		vol, exists = d.volume(r.Name)
+		if !exists {
+			vol, exists = d.resolvedVolume(r.Name)
+		}
+		if !exists {
+			vol, exists = d.fieldVolume(r.Name)
+		}
 		if !exists {
 			return nil, fmt.Errorf("volume %s not found", r.Name)
 		}
 	}
-	return &volume.GetResponse{
+	d.mu.RLock()
+	secretName, updatedAt := vol.SecretName, vol.UpdatedAt
+	d.mu.RUnlock()
+	resp := &volume.GetResponse{
 		Volume: &volume.Volume{
 			Name:      r.Name,
-			CreatedAt: vol.UpdatedAt.Format(time.RFC3339),
+			CreatedAt: updatedAt.Format(time.RFC3339),
 		},
-	}, nil
+	}
+	if vh, ok := d.backend.(versionHistory); ok {
+		if versions := vh.VersionHistory(secretName); len(versions) > 0 {
+			resp.Volume.Status = map[string]interface{}{"versions": versions}
+		}
+	}
+	return resp, nil
 }
 
-func (d *VolumeDriver) Remove(r *volume.RemoveRequest) error {
-	return fmt.Errorf("not implemented. Remove secret from %s instead", backendType)
+// resolvedVolume registers volume which backend can serve even though it is
+// not listed, e.g. db-password.previous. Volume is registered only if the
+// secret can be fetched.
+func (d *VolumeDriver) resolvedVolume(name string) (*volumeInfo, bool) {
+	resolver, ok := d.backend.(secretResolver)
+	if !ok || !validVolumeName(name) {
+		return nil, false
+	}
+	secretName, ok := resolver.ResolveSecret(name)
+	if !ok {
+		return nil, false
+	}
+	if _, err := d.fetchSecret(name, secretName); err != nil {
+		log.Errorf("Failed to fetch secret %s for volume %s: %v", secretName, name, err)
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.releaseUnmounted(secretName)
+	vol := &volumeInfo{
+		SecretName: secretName,
+		Valid:      true,
+	}
+	d.volumes[name] = vol
+	d.saveDB()
+	return vol, true
 }
 
-func (d *VolumeDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+// fieldVolume registers volume which exposes a single field of an existing
+// secret, e.g. db-creds.username for field username of secret db-creds.
+// Volume is registered only if the secret has that field.
+func (d *VolumeDriver) fieldVolume(name string) (*volumeInfo, bool) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 || i == len(name)-1 || !validVolumeName(name) {
+		return nil, false
+	}
+
 	d.mu.RLock()
-	volumes := d.volumes
+	parent, exists := d.volumes[name[:i]]
 	d.mu.RUnlock()
+	if !exists || !parent.Valid || parent.Disabled || parent.Field != "" || parent.Bundle != nil || parent.Template != nil || parent.Format != "" {
+		return nil, false
+	}
+	secret, err := d.fetchSecret(name, parent.SecretName)
+	if err != nil {
+		log.Errorf("Failed to fetch secret %s for volume %s: %v", parent.SecretName, name, err)
+		return nil, false
+	}
+	_, err = secret.Field(name[i+1:])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.releaseUnmounted(parent.SecretName)
+	if err != nil {
+		return nil, false
+	}
+	vol := &volumeInfo{
+		SecretName: parent.SecretName,
+		Field:      name[i+1:],
+		Valid:      true,
+		UID:        parent.UID,
+		GID:        parent.GID,
+		Mode:       parent.Mode,
+		DirMode:    parent.DirMode,
+		Layout:     parent.Layout,
+	}
+	d.volumes[name] = vol
+	d.saveDB()
+	return vol, true
+}
 
-	_, exists := volumes[r.Name]
+// Remove deletes alias volumes created with driver options, volumes
+// exposing a single field and pinned versions. Secrets themselves are never
+// removed from the backend.
+func (d *VolumeDriver) Remove(r *volume.RemoveRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[r.Name]
 	if !exists {
+		return fmt.Errorf("volume %s not found", r.Name)
+	}
+	if !vol.Alias && vol.Field == "" && vol.SecretName == r.Name {
+		return fmt.Errorf("not implemented. Remove secret from %s instead", backendType)
+	}
+	if len(d.mounts[r.Name]) > 0 {
+		return fmt.Errorf("volume %s is in use", r.Name)
+	}
+	if err := wipeSecret(volumePath(r.Name)); err != nil {
+		return fmt.Errorf("error removing secret file of volume %s: %v", r.Name, err)
+	}
+	removeCache(r.Name)
+	delete(d.volumes, r.Name)
+	d.saveDB()
+	return nil
+}
+
+func (d *VolumeDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+	if _, exists := d.volume(r.Name); !exists {
 		return nil, fmt.Errorf("volume %s not found", r.Name)
 	}
-	secretFile := filepath.Join(baseDir, r.Name)
+	secretFile := volumePath(r.Name)
 	return &volume.PathResponse{Mountpoint: secretFile}, nil
 }
 
 func (d *VolumeDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
-	d.mu.RLock()
-	volumes := d.volumes
-	d.mu.RUnlock()
-
-	vol, exists := volumes[r.Name]
+	vol, exists := d.volume(r.Name)
 	if !exists {
 		return nil, fmt.Errorf("volume %s not found", r.Name)
 	}
-	secretFile := filepath.Join(baseDir, r.Name)
+	secretFile := volumePath(r.Name)
 
-	if _, err := os.Stat(secretFile); os.IsNotExist(err) || time.Since(vol.UpdatedAt) >= time.Hour {
-		d.mu.Lock()
-		if err := d.updateSecretFile(r.Name, vol, true); err != nil {
-			log.Errorf("Failed to update secret for volume %s: %v", r.Name, err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.available(vol) {
+		return nil, fmt.Errorf("volume %s is not available in %s", r.Name, backendType)
+	}
+	if _, err := os.Stat(secretFile); os.IsNotExist(err) || time.Since(vol.UpdatedAt) >= time.Hour ||
+		(!vol.RefreshAt.IsZero() && time.Now().After(vol.RefreshAt)) {
+		if err := d.updateSecretFile(r.Name, vol, true, d.mountCacheMaxAge()); err != nil {
+			var unavailable *backend.UnavailableError
+			if errors.As(err, &unavailable) {
+				return nil, err
+			}
+			if err := d.checkMountPolicy(r.Name, vol, err); err != nil {
+				log.Errorf("Refusing to mount volume %s: %v", r.Name, err)
+				return nil, err
+			}
+			log.Errorf("Failed to update secret for volume %s, using existing one: %v", r.Name, err)
 		}
-		d.mu.Unlock()
 	}
+	if d.mounts[r.Name] == nil {
+		d.mounts[r.Name] = make(map[string]struct{})
+	}
+	d.mounts[r.Name][r.ID] = struct{}{}
+	d.saveDB()
 
 	return &volume.MountResponse{Mountpoint: secretFile}, nil
 }
 
-func (d *VolumeDriver) Unmount(r *volume.UnmountRequest) error {
-	d.mu.RLock()
-	volumes := d.volumes
-	d.mu.RUnlock()
+// mountCacheMaxAge returns how old cached secret can be used on mount.
+func (d *VolumeDriver) mountCacheMaxAge() time.Duration {
+	switch {
+	case d.mountPolicy == mountStrict:
+		return 0
+	case d.mountPolicy == mountStale && d.maxStale < d.cacheMaxAge:
+		return d.maxStale
+	}
+	return d.cacheMaxAge
+}
 
-	if _, exists := volumes[r.Name]; !exists {
+// checkMountPolicy tells if volume can be mounted with existing secret file
+// when updating it failed.
+func (d *VolumeDriver) checkMountPolicy(volumeName string, vol *volumeInfo, updateErr error) error {
+	if d.mountPolicy == mountStrict {
+		return fmt.Errorf("cannot mount volume %s: %v", volumeName, updateErr)
+	}
+	if _, err := os.Stat(volumePath(volumeName)); err != nil {
+		return fmt.Errorf("cannot mount volume %s, no earlier secret available: %v", volumeName, updateErr)
+	}
+	if d.mountPolicy == mountStale {
+		if age := time.Since(vol.FetchedAt); vol.FetchedAt.IsZero() || age > d.maxStale {
+			return fmt.Errorf("cannot mount volume %s, earlier secret is older than %s: %v", volumeName, d.maxStale, updateErr)
+		}
+	}
+	return nil
+}
+
+func (d *VolumeDriver) Unmount(r *volume.UnmountRequest) error {
+	vol, exists := d.volume(r.Name)
+	if !exists {
 		return fmt.Errorf("volume %s not found", r.Name)
 	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, known := d.mounts[r.Name][r.ID]
+	delete(d.mounts[r.Name], r.ID)
+	if len(d.mounts[r.Name]) > 0 {
+		d.saveDB()
+		return nil
+	}
+	delete(d.mounts, r.Name)
+	d.saveDB()
+
+	// Secret is fetched again on next mount. Unknown mount means that mounts
+	// were lost, e.g. database was not written, and other containers might
+	// still use the secret so it is not wiped.
+	if known {
+		if err := wipeSecret(volumePath(r.Name)); err != nil {
+			log.Errorf("Failed to wipe secret of volume %s: %v", r.Name, err)
+		}
+	} else if err := unlinkSecret(volumePath(r.Name)); err != nil {
+		log.Errorf("Failed to remove secret of volume %s: %v", r.Name, err)
+	}
+
+	if vol.Bundle != nil || vol.Template != nil {
+		return nil
+	}
+
+	// Field volumes share credentials of their secret
+	if !d.secretMounted(vol.SecretName) {
+		d.releaseSecret(vol.SecretName)
+	}
 	return nil
 }
 
+// releaseUnmounted releases secret fetched only to check it, so credentials
+// issued for the check are not left behind. Secrets used by mounted volumes
+// are kept.
+func (d *VolumeDriver) releaseUnmounted(secretName string) {
+	if secretName != "" && !d.secretMounted(secretName) {
+		d.releaseSecret(secretName)
+	}
+}
+
+// releaseSecret tells backend that secret is not used anymore, e.g. to
+// revoke leased credentials.
+func (d *VolumeDriver) releaseSecret(secretName string) {
+	releaser, ok := d.backend.(secretReleaser)
+	if !ok {
+		return
+	}
+	if err := releaser.ReleaseSecret(secretName); err != nil {
+		log.Errorf("Failed to release secret %s: %v", secretName, err)
+	}
+	d.saveLeases()
+}
+
+// loadLeases restores leases stored by saveLeases.
+func (d *VolumeDriver) loadLeases() {
+	keeper, ok := d.backend.(leaseKeeper)
+	if !ok {
+		return
+	}
+	data, err := readSealed(filepath.Join(baseDir, leaseFile))
+	if err == nil {
+		err = keeper.RestoreLeases(data)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to restore leases: %v", err)
+	}
+}
+
+// saveLeases stores leases of backend encrypted to disk.
+func (d *VolumeDriver) saveLeases() {
+	keeper, ok := d.backend.(leaseKeeper)
+	if !ok {
+		return
+	}
+	data, err := keeper.Leases()
+	if err == nil {
+		err = writeSealed(filepath.Join(baseDir, leaseFile), data)
+	}
+	if err != nil {
+		log.Errorf("Failed to store leases: %v", err)
+	}
+}
+
+// secretMounted tells if any mounted volume uses secret.
+func (d *VolumeDriver) secretMounted(secretName string) bool {
+	for name := range d.mounts {
+		if d.volumes[name].SecretName == secretName {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *VolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 	return &volume.CapabilitiesResponse{
 		Capabilities: volume.Capability{Scope: "local"},
@@ -240,9 +905,13 @@ func main() {
 
 	log.SetFormatter(&simpleFormatter{})
 
+	if v := os.Getenv("SECRET_KEY_FILE"); v != "" {
+		keyPath = v
+	}
+
 	backendType = os.Getenv("SECRET_BACKEND")
 	if backendType == "" {
-		log.Fatal("SECRET_BACKEND environment variable is required (azure, passwordstate, vault)")
+		log.Fatal("SECRET_BACKEND environment variable is required (azure, appconfig, passwordstate, vault)")
 	}
 
 	var b SecretBackend
@@ -250,17 +919,15 @@ func main() {
 
 	switch backendType {
 	case "azure":
-		azureTenantID := os.Getenv("AZURE_TENANT_ID")
-		if azureTenantID == "" {
-			log.Fatal("AZURE_TENANT_ID environment variable is required")
-		}
-		azureClientID := os.Getenv("AZURE_CLIENT_ID")
-		if azureClientID == "" {
-			log.Fatal("AZURE_CLIENT_ID environment variable is required")
-		}
-		azureClientSecret := os.Getenv("AZURE_CLIENT_SECRET")
-		if azureClientSecret == "" {
-			log.Fatal("AZURE_CLIENT_SECRET environment variable is required")
+		// Managed identity is used when none of these is set
+		if os.Getenv("AZURE_CLIENT_SECRET") != "" || os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH") != "" ||
+			os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" {
+			if os.Getenv("AZURE_TENANT_ID") == "" {
+				log.Fatal("AZURE_TENANT_ID environment variable is required")
+			}
+			if os.Getenv("AZURE_CLIENT_ID") == "" {
+				log.Fatal("AZURE_CLIENT_ID environment variable is required")
+			}
 		}
 		keyVaultURL := os.Getenv("AZURE_KEYVAULT_URL")
 		if keyVaultURL == "" {
@@ -271,23 +938,44 @@ func main() {
 			log.Fatalf("Failed to initialize Azure Key Vault backend: %v", err)
 		}
 
-	case "vault":
-		vaultAddr := os.Getenv("VAULT_ADDR")
-		if vaultAddr == "" {
-			log.Fatal("VAULT_ADDR environment variable is required")
+	case "appconfig":
+		endpoint := os.Getenv("AZURE_APPCONFIG_ENDPOINT")
+		if endpoint == "" {
+			log.Fatal("AZURE_APPCONFIG_ENDPOINT environment variable is required")
 		}
+		b, err = backend.NewAppConfigurationBackend(endpoint, os.Getenv("AZURE_APPCONFIG_LABEL"))
+		if err != nil {
+			log.Fatalf("Failed to initialize Azure App Configuration backend: %v", err)
+		}
+
+	case "vault":
 		vaultPath := os.Getenv("VAULT_PATH")
-		if vaultPath == "" {
-			log.Fatal("VAULT_PATH environment variable is required")
+		databasePath := os.Getenv("VAULT_DATABASE_PATH")
+		pkiPath := os.Getenv("VAULT_PKI_PATH")
+		if vaultPath == "" && databasePath == "" && pkiPath == "" {
+			log.Fatal("VAULT_PATH, VAULT_DATABASE_PATH or VAULT_PKI_PATH environment variable is required")
 		}
-		vaultToken := os.Getenv("VAULT_TOKEN")
-		if vaultToken == "" {
-			log.Fatal("VAULT_TOKEN environment variable is required")
+		vb := newVaultBackend(vaultPath)
+		if databasePath != "" {
+			vb.EnableDatabaseCredentials(databasePath)
 		}
-		b, err = backend.NewVaultBackend(vaultAddr, vaultPath, vaultToken)
-		if err != nil {
-			log.Fatalf("Failed to initialize HashiCorp Vault backend: %v", err)
+		if pkiPath != "" {
+			commonName := os.Getenv("VAULT_PKI_COMMON_NAME")
+			if commonName == "" {
+				if commonName, err = os.Hostname(); err != nil {
+					log.Fatalf("Failed to read hostname for VAULT_PKI_COMMON_NAME: %v", err)
+				}
+			}
+			renewFraction := 0.66
+			if s := os.Getenv("VAULT_PKI_RENEW_FRACTION"); s != "" {
+				renewFraction, err = strconv.ParseFloat(s, 64)
+				if err != nil || renewFraction <= 0 || renewFraction >= 1 {
+					log.Fatalf("VAULT_PKI_RENEW_FRACTION must be a number between 0 and 1, got %q", s)
+				}
+			}
+			vb.EnablePKI(pkiPath, commonName, os.Getenv("VAULT_PKI_TTL"), renewFraction)
 		}
+		b = vb
 	case "passwordstate":
 		baseURL := os.Getenv("PASSWORDSTATE_BASE_URL")
 		if baseURL == "" {
@@ -297,56 +985,268 @@ func main() {
 		if apiKey == "" {
 			log.Fatal("PASSWORDSTATE_API_KEY environment variable is required")
 		}
-		listID := os.Getenv("PASSWORDSTATE_LIST_ID")
-		if listID == "" {
-			log.Fatal("PASSWORDSTATE_LIST_ID environment variable is required")
+		var listIDs []string
+		for _, id := range strings.Split(os.Getenv("PASSWORDSTATE_LIST_ID"), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				listIDs = append(listIDs, id)
+			}
+		}
+		treePath := os.Getenv("PASSWORDSTATE_TREE_PATH")
+		if len(listIDs) == 0 && treePath == "" {
+			log.Fatal("PASSWORDSTATE_LIST_ID or PASSWORDSTATE_TREE_PATH environment variable is required")
 		}
-		b = backend.NewPasswordstateBackend(baseURL, apiKey, listID)
+		audit := false
+		if v := os.Getenv("PASSWORDSTATE_AUDIT"); v != "" {
+			if audit, err = strconv.ParseBool(v); err != nil {
+				log.Fatalf("Invalid PASSWORDSTATE_AUDIT: %v", err)
+			}
+		}
+		b = backend.NewPasswordstateBackend(baseURL, apiKey, listIDs, treePath, audit)
 	default:
 		log.Fatalf("Unsupported backend: %s", backendType)
 	}
 
-	d := NewVolumeDriver(b)
+	var transit *backend.TransitDecrypter
+	if transitKey := os.Getenv("VAULT_TRANSIT_KEY"); transitKey != "" {
+		transitPath := os.Getenv("VAULT_TRANSIT_PATH")
+		if transitPath == "" {
+			transitPath = "transit"
+		}
+		transit = backend.NewTransitDecrypter(newVaultBackend(""), transitPath, transitKey)
+	}
+
+	policyPath := os.Getenv("SECRET_POLICY_FILE")
+	if policyPath == "" {
+		policyPath = filepath.Join(baseDir, policyFile)
+	}
+	policy, err := loadPolicy(policyPath)
+	if err != nil {
+		log.Fatalf("Failed to read policy: %v", err)
+	}
+	if err := setupVolumesDir(); err != nil {
+		log.Fatalf("Failed to set up secret store: %v", err)
+	}
+	var cacheMaxAge time.Duration
+	if v := os.Getenv("SECRET_CACHE_MAX_AGE"); v != "" {
+		if cacheMaxAge, err = time.ParseDuration(v); err != nil || cacheMaxAge <= 0 {
+			log.Fatalf("Invalid SECRET_CACHE_MAX_AGE %q, must be positive duration e.g. 24h", v)
+		}
+	}
+	mountPolicy := os.Getenv("SECRET_MOUNT_POLICY")
+	var maxStale time.Duration
+	switch mountPolicy {
+	case "":
+		mountPolicy = mountCached
+	case mountStrict, mountCached:
+	case mountStale:
+		v := os.Getenv("SECRET_MOUNT_MAX_STALE")
+		if maxStale, err = time.ParseDuration(v); err != nil || maxStale <= 0 {
+			log.Fatalf("Invalid SECRET_MOUNT_MAX_STALE %q, must be positive duration e.g. 4h", v)
+		}
+	default:
+		log.Fatalf("Invalid SECRET_MOUNT_POLICY %q, must be %s, %s or %s", mountPolicy, mountStrict, mountCached, mountStale)
+	}
+	d := NewVolumeDriver(b, transit, policy, cacheMaxAge, mountPolicy, maxStale)
 	h := volume.NewHandler(d)
 
 	log.Infof("Starting secret plugin with %s backend", backendType)
 	serve(h)
 }
 
-func (d *VolumeDriver) loadDB() error {
+// newVaultBackend connects to HashiCorp Vault configured with environment
+// variables. It is used both by vault backend and Transit decryption.
+func newVaultBackend(path string) *backend.VaultBackend {
+	vaultAddr := os.Getenv("VAULT_ADDR")
+	if vaultAddr == "" {
+		log.Fatal("VAULT_ADDR environment variable is required")
+	}
+	vaultToken := os.Getenv("VAULT_TOKEN")
+	if vaultToken != "" {
+		vb, err := backend.NewVaultBackend(vaultAddr, path, vaultToken)
+		if err != nil {
+			log.Fatalf("Failed to initialize HashiCorp Vault backend: %v", err)
+		}
+		return vb
+	}
+
+	wrappingToken := os.Getenv("VAULT_WRAPPING_TOKEN")
+	if wrappingToken == "" {
+		log.Fatal("VAULT_TOKEN or VAULT_WRAPPING_TOKEN environment variable is required")
+	}
+	cred, err := loadVaultCredential(vaultAddr, wrappingToken)
+	if err != nil {
+		log.Fatalf("Failed to read HashiCorp Vault credential: %v", err)
+	}
+	if cred.Token != "" {
+		vb, err := backend.NewVaultRenewedTokenBackend(vaultAddr, path, cred.Token)
+		if err != nil {
+			log.Fatalf("Failed to initialize HashiCorp Vault backend: %v", err)
+		}
+		return vb
+	}
+	roleID := os.Getenv("VAULT_ROLE_ID")
+	if roleID == "" {
+		log.Fatal("VAULT_ROLE_ID environment variable is required when wrapping token contains AppRole secret_id")
+	}
+	vb, err := backend.NewVaultAppRoleBackend(vaultAddr, path, roleID, cred.SecretID)
+	if err != nil {
+		log.Fatalf("Failed to initialize HashiCorp Vault backend: %v", err)
+	}
+	return vb
+}
+
+// loadVaultCredential unwraps credential from single use wrapping token on
+// first start and stores it encrypted so wrapping token is useless after it.
+func loadVaultCredential(vaultAddr, wrappingToken string) (*backend.VaultCredential, error) {
+	var stored struct {
+		WrappingTokenHash string
+		Credential        backend.VaultCredential
+	}
+	credPath := filepath.Join(baseDir, credentialFile)
+	hash := sha256.Sum256([]byte(wrappingToken))
+	tokenHash := hex.EncodeToString(hash[:])
+
+	if data, err := readSealed(credPath); err == nil {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", credPath, err)
+		}
+		if stored.WrappingTokenHash == tokenHash {
+			return &stored.Credential, nil
+		}
+		log.Infof("VAULT_WRAPPING_TOKEN has changed, unwrapping new credential")
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cred, err := backend.UnwrapVaultCredential(vaultAddr, wrappingToken)
+	if err != nil {
+		return nil, err
+	}
+	stored.WrappingTokenHash = tokenHash
+	stored.Credential = *cred
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSealed(credPath, data); err != nil {
+		return nil, fmt.Errorf("error storing credential: %v", err)
+	}
+	return cred, nil
+}
+
+// dbState is the content of database file. Earlier versions stored only the
+// volumes. Mounts are stored so secrets of running containers are not wiped
+// when they are unmounted after restart.
+type dbState struct {
+	Version int
+	Volumes map[string]volumeInfo
+	Mounts  map[string][]string
+}
+
+// loadDB reads volumes from database file and returns version of the file.
+func (d *VolumeDriver) loadDB() (int, error) {
 	dbPath := filepath.Join(baseDir, dbFile)
 	data, err := os.ReadFile(dbPath)
 	if err != nil {
-		return nil
+		return 0, nil
 	}
-	var m map[string]volumeInfo
-	if err := json.Unmarshal(data, &m); err != nil {
-		return err
+	var state dbState
+	if err := json.Unmarshal(data, &state); err != nil || state.Version == 0 {
+		state = dbState{}
+		if err := json.Unmarshal(data, &state.Volumes); err != nil {
+			return 0, err
+		}
 	}
-	for name, info := range m {
+	for name, info := range state.Volumes {
 		d.volumes[name] = &volumeInfo{
 			SecretName: info.SecretName,
+			Field:      info.Field,
 			UpdatedAt:  info.UpdatedAt,
 			ExpiresAt:  info.ExpiresAt,
+			RefreshAt:  info.RefreshAt,
+			FetchedAt:  info.FetchedAt,
 			Valid:      info.Valid,
+			Disabled:   info.Disabled,
+			Alias:      info.Alias,
+			UID:        info.UID,
+			GID:        info.GID,
+			Mode:       info.Mode,
+			DirMode:    info.DirMode,
+			Layout:     info.Layout,
+			Bundle:     info.Bundle,
+			Template:   info.Template,
+			Format:     info.Format,
 		}
 	}
-	return nil
+	for name, ids := range state.Mounts {
+		// Secrets of mounted volumes are gone when host has restarted
+		if _, err := os.Stat(volumePath(name)); err != nil {
+			continue
+		}
+		d.mounts[name] = make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			d.mounts[name][id] = struct{}{}
+		}
+	}
+	return state.Version, nil
+}
+
+// migrateDB cleans up after earlier versions and stores database in current
+// format so it is done only once.
+func (d *VolumeDriver) migrateDB(version int) {
+	// Earlier versions stored secrets next to the database
+	if version < 1 && volumesDir != baseDir {
+		for name := range d.volumes {
+			// Files were written only for valid names
+			if !validName.MatchString(name) || slices.Contains(stateFiles, name) {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(baseDir, name)); err != nil {
+				log.Errorf("Failed to remove secret of volume %s from disk: %v", name, err)
+			}
+		}
+	}
+	if err := d.saveDB(); err != nil {
+		log.Errorf("Failed to write database to disk: %v", err)
+	}
 }
 
 func (d *VolumeDriver) saveDB() error {
 	dbPath := filepath.Join(baseDir, dbFile)
 	tmp := dbPath + ".tmp"
-	m := make(map[string]volumeInfo, len(d.volumes))
+	state := dbState{
+		Version: dbVersion,
+		Volumes: make(map[string]volumeInfo, len(d.volumes)),
+		Mounts:  make(map[string][]string, len(d.mounts)),
+	}
+	for name, ids := range d.mounts {
+		for id := range ids {
+			state.Mounts[name] = append(state.Mounts[name], id)
+		}
+		slices.Sort(state.Mounts[name])
+	}
 	for name, v := range d.volumes {
-		m[name] = volumeInfo{
+		state.Volumes[name] = volumeInfo{
 			SecretName: v.SecretName,
+			Field:      v.Field,
 			UpdatedAt:  v.UpdatedAt,
 			ExpiresAt:  v.ExpiresAt,
+			RefreshAt:  v.RefreshAt,
+			FetchedAt:  v.FetchedAt,
 			Valid:      v.Valid,
+			Disabled:   v.Disabled,
+			Alias:      v.Alias,
+			UID:        v.UID,
+			GID:        v.GID,
+			Mode:       v.Mode,
+			DirMode:    v.DirMode,
+			Layout:     v.Layout,
+			Bundle:     v.Bundle,
+			Template:   v.Template,
+			Format:     v.Format,
 		}
 	}
-	data, err := json.MarshalIndent(m, "", "  ")
+	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+// fakeBackend serves secrets from memory. Secrets in hidden are not listed
+// and all fetches fail when err is set.
+type fakeBackend struct {
+	mu       sync.Mutex
+	secrets  map[string]*backend.FetchSecretResponse
+	hidden   map[string]bool
+	err      error
+	released []string
+}
+
+func (b *fakeBackend) FetchSecret(secretName string) (*backend.FetchSecretResponse, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return nil, b.err
+	}
+	secret, ok := b.secrets[secretName]
+	if !ok {
+		return nil, fmt.Errorf("secret %s not found", secretName)
+	}
+	s := *secret
+	return &s, nil
+}
+
+func (b *fakeBackend) ListSecrets() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.secrets {
+		if !b.hidden[name] {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (b *fakeBackend) ReleaseSecret(secretName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.released = append(b.released, secretName)
+	return nil
+}
+
+func (b *fakeBackend) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+// newTestDriver returns driver which keeps its state in temporary directory.
+func newTestDriver(t *testing.T, b SecretBackend, cacheMaxAge time.Duration, mountPolicy string, maxStale time.Duration) *VolumeDriver {
+	t.Helper()
+	baseDir = t.TempDir()
+	volumesDir = filepath.Join(baseDir, ".volumes")
+	keyPath = filepath.Join(baseDir, keyFile)
+	backendType = "fake"
+	if err := os.MkdirAll(volumesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewVolumeDriver(b, nil, nil, cacheMaxAge, mountPolicy, maxStale)
+}
+
+func listed(t *testing.T, d *VolumeDriver) []string {
+	t.Helper()
+	resp, err := d.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, v := range resp.Volumes {
+		names = append(names, v.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestAliasOfInvalidSecretName(t *testing.T) {
+	b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+		"Prod/DB_Password": {Value: "pw"},
+	}}
+	d := newTestDriver(t, b, 0, mountCached, 0)
+
+	if err := d.Create(&volume.CreateRequest{Name: "app-db-pw", Options: map[string]string{"secret": "Prod/DB_Password"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := listed(t, d); !slices.Equal(got, []string{"app-db-pw"}) {
+		t.Fatalf("listed %v, want [app-db-pw]", got)
+	}
+	resp, err := d.Mount(&volume.MountRequest{Name: "app-db-pw", ID: "c1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(resp.Mountpoint); err != nil || string(data) != "pw" {
+		t.Fatalf("secret file = %q, %v", data, err)
+	}
+
+	// Alias follows the secret when backend stops listing it
+	b.hidden = map[string]bool{"Prod/DB_Password": true}
+	if got := listed(t, d); len(got) != 0 {
+		t.Fatalf("listed %v after secret was disabled", got)
+	}
+}
+
+func TestListDuringCreateAndRemove(t *testing.T) {
+	b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+		"db": {Value: "pw"},
+	}}
+	d := newTestDriver(t, b, 0, mountCached, 0)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			name := fmt.Sprintf("alias-%d", i)
+			if err := d.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"secret": "db"}}); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := d.Remove(&volume.RemoveRequest{Name: name}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		d.List()
+		d.Get(&volume.GetRequest{Name: "db"})
+	}
+	wg.Wait()
+}
+
+func TestCreateReleasesCheckedSecret(t *testing.T) {
+	b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+		"database.app": {Fields: map[string]string{"username": "u", "password": "p"}},
+	}}
+	d := newTestDriver(t, b, 0, mountCached, 0)
+
+	if err := d.Create(&volume.CreateRequest{Name: "app-user", Options: map[string]string{"secret": "database.app", "field": "username"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(b.released, []string{"database.app"}) {
+		t.Fatalf("released %v, want credentials of the check released", b.released)
+	}
+
+	// Credentials of mounted volumes are kept
+	if _, err := d.Mount(&volume.MountRequest{Name: "app-user", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	b.released = nil
+	if err := d.Create(&volume.CreateRequest{Name: "app-pw", Options: map[string]string{"secret": "database.app", "field": "password"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.released) != 0 {
+		t.Fatalf("released %v while secret is mounted", b.released)
+	}
+}
+
+func TestUnmountKnownMounts(t *testing.T) {
+	b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+		"db": {Value: "pw"},
+	}}
+	d := newTestDriver(t, b, 0, mountCached, 0)
+	if err := d.Create(&volume.CreateRequest{Name: "app-db", Options: map[string]string{"secret": "db"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := d.Mount(&volume.MountRequest{Name: "app-db", ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := volumePath("app-db")
+	// Containers keep using the inode which was bind mounted to them
+	link := filepath.Join(baseDir, "container-view")
+	if err := os.Link(file, link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mounts survive plugin restart
+	d = NewVolumeDriver(b, nil, nil, 0, mountCached, 0)
+	b.released = nil
+	if err := d.Unmount(&volume.UnmountRequest{Name: "app-db", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("secret removed while still mounted: %v", err)
+	}
+	if len(b.released) != 0 {
+		t.Fatalf("released %v while still mounted", b.released)
+	}
+
+	if err := d.Unmount(&volume.UnmountRequest{Name: "app-db", ID: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("secret not removed after last unmount: %v", err)
+	}
+	if data, err := os.ReadFile(link); err != nil || strings.Trim(string(data), "\x00") != "" {
+		t.Fatalf("secret not wiped, content %q, %v", data, err)
+	}
+	if !slices.Equal(b.released, []string{"db"}) {
+		t.Fatalf("released %v, want [db]", b.released)
+	}
+}
+
+func TestUnmountUnknownMount(t *testing.T) {
+	b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+		"db":   {Value: "pw"},
+		"cert": {Files: map[string]string{"cert.pem": "c", "key.pem": "k"}},
+	}}
+	d := newTestDriver(t, b, 0, mountCached, 0)
+	for _, name := range []string{"db", "cert"} {
+		if err := d.Create(&volume.CreateRequest{Name: "app-" + name, Options: map[string]string{"secret": name}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Mount(&volume.MountRequest{Name: "app-" + name, ID: "c1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := filepath.Join(baseDir, "container-view")
+	if err := os.Link(volumePath("app-db"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mounts were lost, e.g. database was not written before crash
+	d.mu.Lock()
+	d.mounts = make(map[string]map[string]struct{})
+	d.mu.Unlock()
+
+	// Other containers might still use the secret so it is only unlinked
+	if err := d.Unmount(&volume.UnmountRequest{Name: "app-db", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(volumePath("app-db")); !os.IsNotExist(err) {
+		t.Fatalf("secret file not removed: %v", err)
+	}
+	if data, err := os.ReadFile(link); err != nil || string(data) != "pw" {
+		t.Fatalf("secret in use was wiped, content %q, %v", data, err)
+	}
+
+	// Directories bind mounted to other containers are left alone
+	if err := d.Unmount(&volume.UnmountRequest{Name: "app-cert", ID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(volumePath("app-cert"), "key.pem")); err != nil || string(data) != "k" {
+		t.Fatalf("secret directory in use was removed, key %q, %v", data, err)
+	}
+}
+
+func TestMountPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		maxStale time.Duration
+		existing bool
+		age      time.Duration
+		wantErr  bool
+	}{
+		{name: "strict with file", policy: mountStrict, existing: true, wantErr: true},
+		{name: "strict without file", policy: mountStrict, wantErr: true},
+		{name: "cached with file", policy: mountCached, existing: true, age: 24 * time.Hour},
+		{name: "cached without file", policy: mountCached, wantErr: true},
+		{name: "stale with fresh file", policy: mountStale, maxStale: time.Hour, existing: true, age: time.Minute},
+		{name: "stale with old file", policy: mountStale, maxStale: time.Hour, existing: true, age: 2 * time.Hour, wantErr: true},
+		{name: "stale without file", policy: mountStale, maxStale: time.Hour, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+				"db": {Value: "pw"},
+			}}
+			d := newTestDriver(t, b, 0, tt.policy, tt.maxStale)
+			if err := d.Create(&volume.CreateRequest{Name: "app-db", Options: map[string]string{"secret": "db"}}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing {
+				if _, err := d.Mount(&volume.MountRequest{Name: "app-db", ID: "c1"}); err != nil {
+					t.Fatal(err)
+				}
+				d.mu.Lock()
+				d.volumes["app-db"].FetchedAt = time.Now().Add(-tt.age)
+				d.mu.Unlock()
+			}
+
+			b.setErr(fmt.Errorf("backend is down"))
+			_, err := d.Mount(&volume.MountRequest{Name: "app-db", ID: "c2"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mount error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMountPolicyWithCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		maxStale time.Duration
+		wantErr  bool
+	}{
+		{name: "strict", policy: mountStrict, wantErr: true},
+		{name: "cached", policy: mountCached},
+		{name: "stale within max age", policy: mountStale, maxStale: time.Hour},
+		{name: "stale over max age", policy: mountStale, maxStale: time.Nanosecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBackend{secrets: map[string]*backend.FetchSecretResponse{
+				"db": {Value: "pw"},
+			}}
+			d := newTestDriver(t, b, 24*time.Hour, tt.policy, tt.maxStale)
+			if err := d.Create(&volume.CreateRequest{Name: "app-db", Options: map[string]string{"secret": "db"}}); err != nil {
+				t.Fatal(err)
+			}
+			// Mounting caches the secret and unmounting removes the file
+			if _, err := d.Mount(&volume.MountRequest{Name: "app-db", ID: "c1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Unmount(&volume.UnmountRequest{Name: "app-db", ID: "c1"}); err != nil {
+				t.Fatal(err)
+			}
+
+			b.setErr(fmt.Errorf("backend is down"))
+			resp, err := d.Mount(&volume.MountRequest{Name: "app-db", ID: "c2"})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("mount succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(resp.Mountpoint); err != nil || string(data) != "pw" {
+				t.Fatalf("secret file = %q, %v", data, err)
+			}
+		})
+	}
+}
@@ -3,14 +3,55 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
+const defaultTmpfsSize = "16m"
+
 var (
 	baseDir = "/secrets"
+	// volumesDir keeps secrets in memory. It cannot clash with volume names
+	// because those must start with letter or number.
+	volumesDir = filepath.Join(baseDir, ".volumes")
 )
 
+// setupVolumesDir mounts size limited tmpfs to volumesDir so secrets never
+// reach the disk. Mount propagates to the host through propagated mount.
+func setupVolumesDir() error {
+	if err := os.MkdirAll(volumesDir, 0755); err != nil {
+		return err
+	}
+
+	// Still mounted when plugin is restarted
+	var st unix.Statfs_t
+	if err := unix.Statfs(volumesDir, &st); err == nil && st.Type == unix.TMPFS_MAGIC {
+		return nil
+	}
+
+	size := os.Getenv("SECRET_TMPFS_SIZE")
+	if size == "" {
+		size = defaultTmpfsSize
+	}
+	err := unix.Mount("tmpfs", volumesDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "size="+size+",mode=0755")
+	if err == nil {
+		return nil
+	}
+
+	optional, _ := strconv.ParseBool(os.Getenv("SECRET_TMPFS_OPTIONAL"))
+	if !optional {
+		return fmt.Errorf("error mounting tmpfs to %s: %v. Set SECRET_TMPFS_OPTIONAL=true to store secrets on disk instead", volumesDir, err)
+	}
+	log.Warnf("Failed to mount tmpfs to %s, storing secrets on disk: %v", volumesDir, err)
+	return nil
+}
+
 func serve(h *volume.Handler) {
 	if err := h.ServeUnix("secret", 0); err != nil {
 		log.Errorf("Error serving volume plugin: %v", err)
@@ -19,8 +19,9 @@ import (
 )
 
 var (
-	baseDir = filepath.Join(sdk.WindowsDefaultDaemonRootDir(), "secrets")
-	npipe   = "//./pipe/docker-secretprovider-plugin"
+	baseDir    = filepath.Join(sdk.WindowsDefaultDaemonRootDir(), "secrets")
+	volumesDir = baseDir
+	npipe      = "//./pipe/docker-secretprovider-plugin"
 
 	// AllowSystemOnly limits pipe access to NT AUTHORITY\SYSTEM
 	AllowSystemOnly = "D:(A;;GA;;;SY)"
@@ -93,6 +94,12 @@ func (p *program) run(debug bool) {
 	}
 }
 
+// setupVolumesDir does nothing on Windows where secrets are stored next to
+// the database.
+func setupVolumesDir() error {
+	return nil
+}
+
 func serve(h *volume.Handler) {
 	prg := &program{h: h}
 	if isSvc, err := svc.IsWindowsService(); err == nil && !isSvc {
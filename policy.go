@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+)
+
+const (
+	policyFile     = "policy.json"
+	defaultDirMode = 0755
+)
+
+// policyRule sets ownership and permissions of volumes which names match to
+// Volume pattern. Options given when volume is created take precedence.
+type policyRule struct {
+	Volume  string
+	UID     *int
+	GID     *int
+	Mode    string
+	DirMode string
+
+	mode    os.FileMode
+	dirMode os.FileMode
+}
+
+// loadPolicy reads policy rules from JSON file. Missing file means no rules.
+func loadPolicy(file string) ([]policyRule, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []policyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", file, err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if _, err := path.Match(r.Volume, ""); err != nil || r.Volume == "" {
+			return nil, fmt.Errorf("invalid volume pattern %q in %s", r.Volume, file)
+		}
+		if r.Mode != "" {
+			if r.mode, err = parseMode(r.Mode); err != nil {
+				return nil, err
+			}
+		}
+		if r.DirMode != "" {
+			if r.dirMode, err = parseMode(r.DirMode); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rules, nil
+}
+
+// parseMode parses octal permissions, e.g. 0400.
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, must be octal permissions e.g. 0400", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// filePerm returns ownership and permissions of volume files. Settings of
+// volume override first matching policy rule which overrides defaults.
+func (d *VolumeDriver) filePerm(volumeName string, vol *volumeInfo) filePerm {
+	perm := filePerm{
+		Mode:    defaultFileMode,
+		DirMode: defaultDirMode,
+	}
+	for _, r := range d.policy {
+		if ok, _ := path.Match(r.Volume, volumeName); !ok {
+			continue
+		}
+		if r.UID != nil {
+			perm.UID = *r.UID
+		}
+		if r.GID != nil {
+			perm.GID = *r.GID
+		}
+		if r.mode != 0 {
+			perm.Mode = r.mode
+		}
+		if r.dirMode != 0 {
+			perm.DirMode = r.dirMode
+		}
+		break
+	}
+	if vol.UID != nil {
+		perm.UID = *vol.UID
+	}
+	if vol.GID != nil {
+		perm.GID = *vol.GID
+	}
+	if vol.Mode != 0 {
+		perm.Mode = vol.Mode
+	}
+	if vol.DirMode != 0 {
+		perm.DirMode = vol.DirMode
+	}
+	return perm
+}
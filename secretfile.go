@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// filePerm defines ownership and permissions of secret files and
+// directories.
+type filePerm struct {
+	UID     int
+	GID     int
+	Mode    os.FileMode
+	DirMode os.FileMode
+}
+
+// apply sets ownership and permissions of path. Ownership is not supported
+// on Windows.
+func (p filePerm) apply(path string, dir bool) error {
+	mode := p.Mode
+	if dir {
+		mode = p.DirMode
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return os.Lchown(path, p.UID, p.GID)
+}
+
+// writeSecretFile writes value to file unless it already has that content.
+func writeSecretFile(path, value string, perm filePerm) (bool, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(path); err != nil {
+			return false, err
+		}
+	}
+	if old, err := os.ReadFile(path); err == nil {
+		if string(old) == value {
+			return false, perm.apply(path, false)
+		}
+		// File is updated in place because it is bind mounted to containers.
+		// Read-only files cannot be opened for writing on Windows.
+		if err := os.Chmod(path, perm.Mode|0200); err != nil {
+			return false, err
+		}
+	}
+	if err := os.WriteFile(path, []byte(value), perm.Mode); err != nil {
+		return false, err
+	}
+	return true, perm.apply(path, false)
+}
+
+// replaceSecretFile writes value to temporary file and renames it over path
+// so readers never see partially written file. Unlike writeSecretFile it
+// cannot be used for files which are bind mounted to containers.
+func replaceSecretFile(path, value string, perm filePerm) (bool, error) {
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(path); err != nil {
+			return false, err
+		}
+	}
+	if old, err := os.ReadFile(path); err == nil {
+		if string(old) == value {
+			return false, perm.apply(path, false)
+		}
+		// Read-only files cannot be replaced on Windows
+		if err := os.Chmod(path, perm.Mode|0200); err != nil {
+			return false, err
+		}
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return false, err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = perm.apply(f.Name(), false)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// checkFileNames fails if any of the files would be written outside of the
+// directory or to the directory itself.
+func checkFileNames(files map[string]string) error {
+	for name := range files {
+		if name == "" || name == "." || strings.HasPrefix(name, "..") || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	return nil
+}
+
+// writeSecretDir makes dir to contain exactly the given files.
+func writeSecretDir(dir string, files map[string]string, perm filePerm) (bool, error) {
+	if err := checkFileNames(files); err != nil {
+		return false, err
+	}
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		if err := os.Remove(dir); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(dir, perm.DirMode); err != nil {
+		return false, err
+	}
+	if err := perm.apply(dir, true); err != nil {
+		return false, err
+	}
+
+	changed := false
+	for name, value := range files {
+		c, err := replaceSecretFile(filepath.Join(dir, name), value, perm)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || c
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if _, ok := files[e.Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// dataDir is the symlink which points to current data directory of
+// directory layout volumes.
+const dataDir = "..data"
+
+// writeAtomicDir makes dir to contain the given files like Kubernetes does
+// with projected volumes. Files are written to new timestamped directory and
+// ..data symlink is swapped to point to it so readers see either old or new
+// content, never partially written one. Files are visible through symlinks
+// pointing inside ..data.
+func writeAtomicDir(dir string, files map[string]string, perm filePerm) (bool, error) {
+	if err := checkFileNames(files); err != nil {
+		return false, err
+	}
+	if fi, err := os.Lstat(dir); err == nil && !fi.IsDir() {
+		if err := os.Remove(dir); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(dir, perm.DirMode); err != nil {
+		return false, err
+	}
+	if err := perm.apply(dir, true); err != nil {
+		return false, err
+	}
+
+	current, _ := os.Readlink(filepath.Join(dir, dataDir))
+	if current != "" && sameFiles(filepath.Join(dir, current), files) {
+		// Permissions might have changed in policy
+		if err := perm.apply(filepath.Join(dir, current), true); err != nil {
+			return false, err
+		}
+		for name := range files {
+			if err := perm.apply(filepath.Join(dir, current, name), false); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	tsDir, err := os.MkdirTemp(dir, time.Now().UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return false, err
+	}
+	for name, value := range files {
+		file := filepath.Join(tsDir, name)
+		if err := os.WriteFile(file, []byte(value), perm.Mode); err != nil {
+			os.RemoveAll(tsDir)
+			return false, err
+		}
+		if err := perm.apply(file, false); err != nil {
+			os.RemoveAll(tsDir)
+			return false, err
+		}
+	}
+	if err := perm.apply(tsDir, true); err != nil {
+		os.RemoveAll(tsDir)
+		return false, err
+	}
+
+	// Rename is atomic so ..data always points to complete directory
+	tmpLink := filepath.Join(dir, dataDir+"_tmp")
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		os.RemoveAll(tsDir)
+		return false, err
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, dataDir)); err != nil {
+		os.Remove(tmpLink)
+		os.RemoveAll(tsDir)
+		return false, err
+	}
+
+	for name := range files {
+		link := filepath.Join(dir, name)
+		if target, err := os.Readlink(link); err == nil && target == filepath.Join(dataDir, name) {
+			continue
+		}
+		os.RemoveAll(link)
+		if err := os.Symlink(filepath.Join(dataDir, name), link); err != nil {
+			return false, err
+		}
+	}
+
+	// Remove old data directories and files which secret does not have anymore
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if _, ok := files[e.Name()]; ok || e.Name() == dataDir || e.Name() == filepath.Base(tsDir) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// sameFiles tells if dir contains exactly the given files.
+func sameFiles(dir string, files map[string]string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != len(files) {
+		return false
+	}
+	for name, value := range files {
+		old, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(old) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// wipeSecret overwrites secret files with zeros before removing them so
+// their content does not stay on disk.
+func wipeSecret(path string) error {
+	err := filepath.WalkDir(path, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		return overwriteFile(p)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+func overwriteFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Read-only files cannot be opened for writing on Windows
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, fi.Size())); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// unlinkSecret removes secret file without overwriting it so containers
+// which have it mounted keep their copy. Directories are left as is because
+// removing their files would remove them from containers too.
+func unlinkSecret(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
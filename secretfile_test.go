@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteAtomicDirSwapsData(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "vol")
+	perm := filePerm{Mode: 0600, DirMode: 0700, UID: os.Getuid(), GID: os.Getgid()}
+
+	versions := []map[string]string{
+		{"cert.pem": "cert1", "key.pem": "key1"},
+		{"cert.pem": "cert2", "key.pem": "key2"},
+		{"cert.pem": "cert3"},
+	}
+	for i, files := range versions {
+		changed, err := writeAtomicDir(dir, files, perm)
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		if !changed {
+			t.Fatalf("write %d did not change volume", i)
+		}
+
+		target, err := os.Readlink(filepath.Join(dir, dataDir))
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "..") && e.Name() != dataDir && e.Name() != target {
+				t.Errorf("write %d left old data directory %s", i, e.Name())
+			}
+			names = append(names, e.Name())
+		}
+		if len(names) != len(files)+2 {
+			t.Errorf("write %d: directory contains %v", i, names)
+		}
+		for name, want := range files {
+			link, err := os.Readlink(filepath.Join(dir, name))
+			if err != nil || link != filepath.Join(dataDir, name) {
+				t.Errorf("write %d: %s links to %q, %v", i, name, link, err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+				t.Errorf("write %d: %s = %q, %v, want %q", i, name, got, err, want)
+			}
+		}
+	}
+
+	changed, err := writeAtomicDir(dir, versions[len(versions)-1], perm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("writing same files changed volume")
+	}
+}
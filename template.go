@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/olljanat/docker-secretprovider-plugin/backend"
+)
+
+// templateInfo defines template volume. Template is given either as Text or
+// it is stored to backend as secret named by Secret.
+type templateInfo struct {
+	Text   string
+	Secret string
+}
+
+// configPrefixes are prefixes of plugin configuration variables which are
+// not available for templates because they contain backend credentials.
+var configPrefixes = []string{"AZURE_", "PASSWORDSTATE_", "SECRET_", "VAULT_"}
+
+// renderTemplate renders template with functions which read secrets from
+// backend. Result is updated when any of the referenced secrets is.
+func (d *VolumeDriver) renderTemplate(volumeName string, t *templateInfo) (*backend.FetchSecretResponse, error) {
+	result := &backend.FetchSecretResponse{}
+	secrets := make(map[string]*backend.FetchSecretResponse)
+	fetch := func(name string) (*backend.FetchSecretResponse, error) {
+		if secret, ok := secrets[name]; ok {
+			return secret, nil
+		}
+		secret, err := d.fetchSecret(volumeName, name)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching secret %s: %w", name, err)
+		}
+		secrets[name] = secret
+		mergeTimes(result, secret)
+		return secret, nil
+	}
+
+	text := t.Text
+	if t.Secret != "" {
+		secret, err := fetch(t.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if text, err = secret.Field(""); err != nil {
+			return nil, fmt.Errorf("error reading template %s: %v", t.Secret, err)
+		}
+	}
+
+	tmpl, err := template.New(volumeName).Funcs(template.FuncMap{
+		"secret": func(name string) (string, error) {
+			secret, err := fetch(name)
+			if err != nil {
+				return "", err
+			}
+			return secret.Field("")
+		},
+		"field": func(name, field string) (string, error) {
+			secret, err := fetch(name)
+			if err != nil {
+				return "", err
+			}
+			return secret.Field(field)
+		},
+		"base64dec": func(s string) (string, error) {
+			data, err := base64.StdEncoding.DecodeString(s)
+			return string(data), err
+		},
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+		"env": func(name string) (string, error) {
+			for _, prefix := range configPrefixes {
+				if strings.HasPrefix(name, prefix) {
+					return "", fmt.Errorf("plugin configuration variable %s is not available", name)
+				}
+			}
+			return os.Getenv(name), nil
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %v", err)
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, nil); err != nil {
+		return nil, fmt.Errorf("error rendering template: %w", err)
+	}
+	result.Value = sb.String()
+	return result, nil
+}